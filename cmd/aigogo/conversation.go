@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/gen"
+	"github.com/siuyin/dflt"
+)
+
+// conversation is a multi-turn exchange with the activities assistant.
+type conversation struct {
+	ID      string
+	UserID  string
+	Title   string // the first user prompt
+	History []*genai.Content
+	Created time.Time
+	Updated time.Time
+}
+
+// maxHistory bounds the number of turns (user and model contents) sent with each message.
+const maxHistory = 20
+
+// maxConversations bounds the conversations kept per user. Starting another
+// drops the least recently updated.
+const maxConversations = 20
+
+// conversationStore keeps conversations in memory. A conversation expires
+// when it has not been updated for ttl.
+type conversationStore struct {
+	mu  sync.Mutex
+	m   map[string]*conversation
+	ttl time.Duration
+}
+
+var conversations = newConversationStore(conversationTTL())
+
+func newConversationStore(ttl time.Duration) *conversationStore {
+	return &conversationStore{m: map[string]*conversation{}, ttl: ttl}
+}
+
+// conversationTTL reads CONVERSATION_TTL, eg. "30m". The default is 2 hours.
+func conversationTTL() time.Duration {
+	d, err := time.ParseDuration(dflt.EnvString("CONVERSATION_TTL", "2h"))
+	if err != nil {
+		log.Fatalf("CONVERSATION_TTL: %v", err)
+	}
+	return d
+}
+
+// prune deletes expired conversations. The caller must hold s.mu.
+func (s *conversationStore) prune(now time.Time) {
+	for id, c := range s.m {
+		if now.Sub(c.Updated) > s.ttl {
+			delete(s.m, id)
+		}
+	}
+}
+
+// get returns a copy of userID's conversation id.
+func (s *conversationStore) get(userID, id string) (conversation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+
+	c, ok := s.m[id]
+	if !ok || c.UserID != userID {
+		return conversation{}, false
+	}
+	return *c, true
+}
+
+// addTurn appends the contents of a turn to the stored conversation c, or
+// stores c with them if it is new, keeping the most recent maxHistory contents.
+// Turns taken concurrently in a conversation are all kept.
+func (s *conversationStore) addTurn(c conversation, turn ...*genai.Content) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.m[c.ID]; ok {
+		c = *stored
+	} else {
+		s.makeRoom(c.UserID)
+	}
+	c.History = append(append([]*genai.Content{}, c.History...), turn...)
+	c.Updated = time.Now()
+	if n := len(c.History); n > maxHistory {
+		c.History = c.History[n-maxHistory:]
+	}
+	s.m[c.ID] = &c
+}
+
+// makeRoom drops userID's least recently updated conversations so that one
+// more can be stored. The caller must hold s.mu.
+func (s *conversationStore) makeRoom(userID string) {
+	s.prune(time.Now())
+	l := []*conversation{}
+	for _, c := range s.m {
+		if c.UserID == userID {
+			l = append(l, c)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Updated.Before(l[j].Updated) })
+	for len(l) >= maxConversations {
+		delete(s.m, l[0].ID)
+		l = l[1:]
+	}
+}
+
+// list returns userID's conversations, most recently updated first.
+func (s *conversationStore) list(userID string) []conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+
+	l := []conversation{}
+	for _, c := range s.m {
+		if c.UserID == userID {
+			l = append(l, *c)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Updated.After(l[j].Updated) })
+	return l
+}
+
+func (s *conversationStore) delete(userID, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.m[id]
+	if !ok || c.UserID != userID {
+		return false
+	}
+	delete(s.m, id)
+	return true
+}
+
+// clear deletes all of userID's conversations.
+func (s *conversationStore) clear(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, c := range s.m {
+		if c.UserID == userID {
+			delete(s.m, id)
+		}
+	}
+}
+
+// conversationFor returns the conversation a /retr request with a userID
+// continues, a new one with conv=new, or nil without a userID or conv.
+// It writes a 404 and returns false if conv is unknown or expired.
+func conversationFor(w http.ResponseWriter, r *http.Request) (*conversation, bool) {
+	userID, id := r.FormValue("userID"), r.FormValue("conv")
+	if userID == "" || id == "" {
+		return nil, true
+	}
+	if id == "new" {
+		now := time.Now()
+		return &conversation{
+			ID:      fmt.Sprintf("conv-%d", now.UnixNano()),
+			UserID:  userID,
+			Title:   r.FormValue("userPrompt"),
+			Created: now,
+		}, true
+	}
+	c, ok := conversations.get(userID, id)
+	if !ok {
+		http.Error(w, "conversation not found or expired: "+id, http.StatusNotFound)
+		return nil, false
+	}
+	return &c, true
+}
+
+// retrievalQuery adds the previous user prompt of c to qry, so that follow-ups
+// like "tell me another one" retrieve documents on the same topic.
+func retrievalQuery(c *conversation, qry string) string {
+	if c == nil {
+		return qry
+	}
+	for i := len(c.History) - 1; i >= 0; i-- {
+		if c.History[i].Role == "user" {
+			return gen.ContentText(c.History[i]) + "\n" + qry
+		}
+	}
+	return qry
+}
+
+// ------------------------------------------------
+
+type conversationSummary struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	Turns   int       `json:"turns"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type turn struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+}
+
+type conversationDetail struct {
+	conversationSummary
+	History []turn `json:"history"`
+}
+
+func summarizeConversation(c conversation) conversationSummary {
+	return conversationSummary{ID: c.ID, Title: c.Title, Turns: len(c.History) / 2, Created: c.Created, Updated: c.Updated}
+}
+
+func requireUserID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID := r.FormValue("userID")
+	if userID == "" {
+		http.Error(w, "userID required", http.StatusBadRequest)
+	}
+	return userID, userID != ""
+}
+
+func conversationListFunc(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	l := []conversationSummary{}
+	for _, c := range conversations.list(userID) {
+		l = append(l, summarizeConversation(c))
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// conversationGetFunc returns a conversation's history so that a client can redraw
+// it and resume with /retr?conv=<id>.
+func conversationGetFunc(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	c, ok := conversations.get(userID, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "conversation not found or expired", http.StatusNotFound)
+		return
+	}
+	d := conversationDetail{conversationSummary: summarizeConversation(c), History: []turn{}}
+	for _, h := range c.History {
+		d.History = append(d.History, turn{Role: h.Role, Text: gen.ContentText(h)})
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+func conversationDeleteFunc(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	if !conversations.delete(userID, r.PathValue("id")) {
+		http.Error(w, "conversation not found or expired", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func conversationClearFunc(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	conversations.clear(userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// experiment splits users between variants of a prompt template.
+type experiment struct {
+	Variants []string `json:"variants"` // template names, the first is the control
+	Weights  []int    `json:"weights"`  // relative share of users per variant, equal if empty
+}
+
+// experiments maps a template name, eg. "caregiver", to its experiment.
+var experiments = map[string]experiment{}
+
+// loadExperiments reads the JSON file named by EXPERIMENTS, eg.
+//
+//	{"caregiver": {"variants": ["caregiver", "caregiver.warm"], "weights": [3, 1]}}
+//
+// Every variant must be a loaded prompt template.
+func loadExperiments() {
+	fn := os.Getenv("EXPERIMENTS")
+	if fn == "" {
+		return
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := map[string]experiment{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Fatalf("could not parse %s: %v", fn, err)
+	}
+	for name, e := range m {
+		if err := e.check(); err != nil {
+			log.Fatalf("experiment %s: %v", name, err)
+		}
+	}
+	experiments = m
+	log.Printf("experiments: %+v", m)
+}
+
+func (e experiment) check() error {
+	if len(e.Variants) == 0 {
+		return fmt.Errorf("no variants")
+	}
+	if len(e.Weights) != 0 && len(e.Weights) != len(e.Variants) {
+		return fmt.Errorf("%d weights for %d variants", len(e.Weights), len(e.Variants))
+	}
+	for _, v := range e.Variants {
+		if _, ok := prompts.Get(v); !ok {
+			return fmt.Errorf("no prompt template called %s", v)
+		}
+	}
+	return nil
+}
+
+// assign picks a variant for userID. The same user always gets the same variant
+// of an experiment. Requests without a userID get the control.
+func (e experiment) assign(name, userID string) string {
+	if userID == "" {
+		return e.Variants[0]
+	}
+	w := e.Weights
+	if len(w) == 0 {
+		w = make([]int, len(e.Variants))
+		for i := range w {
+			w[i] = 1
+		}
+	}
+	total := 0
+	for _, n := range w {
+		total += n
+	}
+
+	h := fnv.New32a()
+	io.WriteString(h, name+"/"+userID)
+	n := int(h.Sum32() % uint32(total))
+	for i, wt := range w {
+		if n < wt {
+			return e.Variants[i]
+		}
+		n -= wt
+	}
+	return e.Variants[0]
+}
+
+// variantFor returns the template to use in place of name for userID.
+func variantFor(name, userID string) string {
+	e, ok := experiments[name]
+	if !ok {
+		return name
+	}
+	return e.assign(name, userID)
+}
+
+// ------------------------------------------------
+
+// responseRecord is a line of the response log: a generated response or feedback on one.
+type responseRecord struct {
+	Type      string    `json:"type"` // "response" or "feedback"
+	ID        string    `json:"id"`   // response ID
+	Time      time.Time `json:"time"`
+	UserID    string    `json:"userID,omitempty"`
+	Endpoint  string    `json:"endpoint"`
+	Prompt    string    `json:"prompt"` // template ID, eg. "caregiver.warm@1"
+	Request   string    `json:"request,omitempty"`
+	Response  string    `json:"response,omitempty"`
+	Failed    bool      `json:"failed,omitempty"`
+	Cancelled bool      `json:"cancelled,omitempty"`
+	Cached    bool      `json:"cached,omitempty"`
+	Rating    int       `json:"rating,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// maxIndexedResponses bounds the responses indexed in memory. Feedback on
+// older responses is recorded after finding them in the file.
+var maxIndexedResponses = 10000
+
+// responseLog appends records to a JSON lines file. The endpoint, user and
+// prompt of the latest responses are indexed so that feedback can be recorded
+// with them. The index is rebuilt from the file on restart.
+type responseLog struct {
+	mu    sync.Mutex
+	fn    string // no records are written if empty
+	index map[string]responseRecord
+	order []string // indexed IDs, oldest first
+}
+
+var responses = &responseLog{index: map[string]responseRecord{}}
+
+// openResponseLog indexes the responses already in fn.
+func openResponseLog(fn string) *responseLog {
+	l := &responseLog{fn: fn, index: map[string]responseRecord{}}
+	if fn == "" {
+		return l
+	}
+	err := l.scan(func(rec responseRecord) {
+		if rec.Type == "response" {
+			l.remember(rec)
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("could not read response log %s: %v", fn, err)
+	}
+	log.Printf("response log %s: %d responses", fn, len(l.index))
+	return l
+}
+
+// initResponseLog opens RESPONSE_LOG, responses are not recorded if it is not set.
+func initResponseLog() *responseLog {
+	return openResponseLog(os.Getenv("RESPONSE_LOG"))
+}
+
+func meta(rec responseRecord) responseRecord {
+	return responseRecord{ID: rec.ID, UserID: rec.UserID, Endpoint: rec.Endpoint, Prompt: rec.Prompt}
+}
+
+// remember indexes the response rec, dropping the oldest beyond
+// maxIndexedResponses. The caller must hold l.mu.
+func (l *responseLog) remember(rec responseRecord) {
+	if _, ok := l.index[rec.ID]; !ok {
+		l.order = append(l.order, rec.ID)
+	}
+	l.index[rec.ID] = meta(rec)
+	for len(l.order) > maxIndexedResponses {
+		delete(l.index, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+func (l *responseLog) append(rec responseRecord) {
+	if l.fn == "" {
+		return // nothing to give feedback on, so nothing to index
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rec.Type == "response" {
+		l.remember(rec)
+	}
+	f, err := os.OpenFile(l.fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("ERROR: could not open response log: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(rec); err != nil {
+		log.Printf("ERROR: could not write response log: %v", err)
+	}
+}
+
+// lookup returns the indexed fields of response id, searching the file for
+// responses no longer indexed.
+func (l *responseLog) lookup(id string) (responseRecord, bool) {
+	l.mu.Lock()
+	rec, ok := l.index[id]
+	l.mu.Unlock()
+	if ok || l.fn == "" {
+		return rec, ok
+	}
+	err := l.scan(func(r responseRecord) {
+		if r.Type == "response" && r.ID == id {
+			rec, ok = meta(r), true
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: could not read response log: %v", err)
+	}
+	return rec, ok
+}
+
+func (l *responseLog) scan(fn func(responseRecord)) error {
+	f, err := os.Open(l.fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<24)
+	for sc.Scan() {
+		var rec responseRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			log.Printf("WARNING: skipping response log line: %v", err)
+			continue
+		}
+		fn(rec)
+	}
+	return sc.Err()
+}
+
+// recordResponse records the response streamed by s.
+func recordResponse(r *http.Request, s *stream, promptID, request string) {
+	responses.append(responseRecord{
+		Type:      "response",
+		ID:        s.id,
+		Time:      time.Now(),
+		UserID:    r.FormValue("userID"),
+		Endpoint:  r.URL.Path,
+		Prompt:    promptID,
+		Request:   request,
+		Response:  s.out.String(),
+		Failed:    s.failed,
+		Cancelled: s.cancelled,
+		Cached:    s.cached,
+	})
+}
+
+// feedbackFunc records a user's rating of a response: responseID, rating (eg. 1 or -1)
+// and an optional comment.
+func feedbackFunc(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("responseID")
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if id == "" || err != nil {
+		http.Error(w, "responseID and numeric rating required", http.StatusBadRequest)
+		return
+	}
+	resp, ok := responses.lookup(id)
+	if !ok {
+		http.Error(w, "response not found: "+id, http.StatusNotFound)
+		return
+	}
+	responses.append(responseRecord{
+		Type:     "feedback",
+		ID:       id,
+		Time:     time.Now(),
+		UserID:   resp.UserID,
+		Endpoint: resp.Endpoint,
+		Prompt:   resp.Prompt,
+		Rating:   rating,
+		Comment:  r.FormValue("comment"),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// experimentExportFunc writes every recorded response as CSV with the latest
+// feedback on it, for comparing prompt variants offline. Responses replayed
+// from the cache are marked, so that they can be left out of a comparison.
+func experimentExportFunc(w http.ResponseWriter, r *http.Request) {
+	if responses.fn == "" {
+		http.Error(w, "response log disabled: RESPONSE_LOG not set", http.StatusNotFound)
+		return
+	}
+	resp := []responseRecord{}
+	fb := map[string]responseRecord{}
+	err := responses.scan(func(rec responseRecord) {
+		switch rec.Type {
+		case "response":
+			resp = append(resp, rec)
+		case "feedback":
+			fb[rec.ID] = rec
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: could not read response log: %v", err)
+		http.Error(w, "could not read response log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="experiments.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "time", "userID", "endpoint", "prompt", "failed", "cancelled", "cached", "request", "response", "rating", "comment"})
+	for _, rec := range resp {
+		f, rated := fb[rec.ID]
+		rating := ""
+		if rated {
+			rating = strconv.Itoa(f.Rating)
+		}
+		cw.Write([]string{rec.ID, rec.Time.Format(time.RFC3339), rec.UserID, rec.Endpoint, rec.Prompt,
+			strconv.FormatBool(rec.Failed), strconv.FormatBool(rec.Cancelled), strconv.FormatBool(rec.Cached), rec.Request, rec.Response, rating, f.Comment})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,172 @@
+// Package bm25 provides an in-memory Okapi BM25 keyword index.
+// Terms are lower case word unigrams and bigrams, so exact multi-word names
+// like "Lor Bak" score higher than documents merely containing "lor" or "bak".
+package bm25
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Index is a BM25 index safe for concurrent use.
+type Index struct {
+	K1 float64 // term frequency saturation
+	B  float64 // document length normalization
+
+	mu       sync.RWMutex
+	tf       map[string]map[string]int // document ID -> term -> frequency
+	length   map[string]int            // document ID -> number of terms
+	df       map[string]int            // term -> number of documents containing it
+	totalLen int
+}
+
+// Result is a document matching a query.
+type Result struct {
+	ID    string
+	Score float64
+	// Match is Score relative to that of a document of average length holding
+	// each query term found in the index once: about 1 when the document has
+	// every query term and lower the fewer it has.
+	Match float64
+}
+
+// New returns an empty index with the usual parameters k1=1.2, b=0.75.
+func New() *Index {
+	return &Index{K1: 1.2, B: 0.75,
+		tf: map[string]map[string]int{}, length: map[string]int{}, df: map[string]int{}}
+}
+
+// Add indexes text under id, replacing any earlier text with the same id.
+func (ix *Index) Add(id, text string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+	terms := Terms(text)
+	tf := map[string]int{}
+	for _, t := range terms {
+		tf[t]++
+	}
+	for t := range tf {
+		ix.df[t]++
+	}
+	ix.tf[id] = tf
+	ix.length[id] = len(terms)
+	ix.totalLen += len(terms)
+}
+
+// Remove removes id from the index.
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	tf, ok := ix.tf[id]
+	if !ok {
+		return
+	}
+	for t := range tf {
+		ix.df[t]--
+		if ix.df[t] == 0 {
+			delete(ix.df, t)
+		}
+	}
+	ix.totalLen -= ix.length[id]
+	delete(ix.tf, id)
+	delete(ix.length, id)
+}
+
+// Len returns the number of indexed documents.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.tf)
+}
+
+// Search returns up to n documents with a positive score for query, best first.
+// If keep is not nil, only documents for which keep returns true are considered.
+func (ix *Index) Search(query string, n int, keep func(id string) bool) []Result {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if len(ix.tf) == 0 {
+		return nil
+	}
+	N := float64(len(ix.tf))
+	avgLen := float64(ix.totalLen) / N
+
+	qterms := map[string]bool{}
+	full := 0.0 // the score of one occurrence of every indexed query term, at average length
+	for _, t := range Terms(query) {
+		if df, ok := ix.df[t]; ok && !qterms[t] {
+			full += idf(N, float64(df))
+		}
+		qterms[t] = true
+	}
+
+	res := []Result{}
+	for id, tf := range ix.tf {
+		if keep != nil && !keep(id) {
+			continue
+		}
+		score := 0.0
+		for t := range qterms {
+			f := float64(tf[t])
+			if f == 0 {
+				continue
+			}
+			norm := 1 - ix.B + ix.B*float64(ix.length[id])/avgLen
+			score += idf(N, float64(ix.df[t])) * f * (ix.K1 + 1) / (f + ix.K1*norm)
+		}
+		if score > 0 {
+			res = append(res, Result{ID: id, Score: score, Match: score / full})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].ID < res[j].ID
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// idf is the inverse document frequency of a term in df of n documents.
+func idf(n, df float64) float64 {
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+// Terms returns the unigrams and bigrams of text, excluding stop words from unigrams.
+func Terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := []string{}
+	for i, w := range words {
+		if !stopWords[w] {
+			terms = append(terms, w)
+		}
+		if i > 0 {
+			terms = append(terms, words[i-1]+" "+w)
+		}
+	}
+	return terms
+}
+
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`a an and are as at be by for from has have how i in is it its
+		me my of on or that the their there these this to was what when where which who will with you your`) {
+		stopWords[w] = true
+	}
+}
@@ -0,0 +1,33 @@
+package bm25
+
+import "testing"
+
+func TestSearch(t *testing.T) {
+	ix := New()
+	ix.Add("1", "Lor Bak | Kimberley Street lor bak is fried meat rolls")
+	ix.Add("2", "Lor Mee | thick noodles in a starchy gravy")
+	ix.Add("3", "Bak Kut Teh | pork rib soup")
+	ix.Add("4", "Roti Prata | flatbread with curry")
+
+	res := ix.Search("where can I eat Lor Bak?", 10, nil)
+	if len(res) != 3 || res[0].ID != "1" {
+		t.Errorf("exact name should rank first, got %v", res)
+	}
+	if res[0].Match < 0.9 || res[1].Match > 0.5 || res[2].Match > 0.5 {
+		t.Errorf("only the document with every query term should match fully: %v", res)
+	}
+
+	res = ix.Search("roti prata", 10, func(id string) bool { return id != "4" })
+	if len(res) != 0 {
+		t.Errorf("filtered out document should not be returned: %v", res)
+	}
+
+	ix.Add("1", "Char Kuay Teow | fried flat noodles")
+	ix.Remove("2")
+	if res := ix.Search("lor", 10, nil); len(res) != 0 {
+		t.Errorf("replaced and removed documents should not match: %v", res)
+	}
+	if ix.Len() != 3 {
+		t.Errorf("index size: %d, expected 3", ix.Len())
+	}
+}
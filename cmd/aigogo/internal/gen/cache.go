@@ -0,0 +1,165 @@
+package gen
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+// Cache holds completed streamed responses for replay. Entries expire after TTL
+// and the least recently used are evicted beyond MaxEntries or MaxBytes of text.
+type Cache struct {
+	TTL        time.Duration
+	MaxEntries int
+	MaxBytes   int
+
+	mu    sync.Mutex
+	lru   *list.List // of *cacheEntry, most recently used first
+	m     map[string]*list.Element
+	bytes int
+}
+
+type cacheEntry struct {
+	key     string
+	chunks  []*genai.GenerateContentResponse
+	merged  *genai.GenerateContentResponse
+	size    int
+	expires time.Time
+}
+
+// NewCache returns an empty cache.
+func NewCache(ttl time.Duration, maxEntries, maxBytes int) *Cache {
+	return &Cache{TTL: ttl, MaxEntries: maxEntries, MaxBytes: maxBytes, lru: list.New(), m: map[string]*list.Element{}}
+}
+
+// Key hashes the parts that determine a response.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Stream replays the response cached under key. Otherwise it calls start and
+// returns an iterator that caches the response once it has been read to the end
+// without error. hit reports whether the response is a replay.
+func (c *Cache) Stream(key string, start func() Iterator) (it Iterator, hit bool) {
+	if e, ok := c.get(key); ok {
+		return &replayIterator{e: e}, true
+	}
+	return &recordingIterator{c: c, key: key, it: start()}, false
+}
+
+// Len returns the number of cached responses.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *Cache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.MaxBytes > 0 && e.size > c.MaxBytes {
+		return
+	}
+	if el, ok := c.m[e.key]; ok {
+		c.remove(el)
+	}
+	e.expires = time.Now().Add(c.TTL)
+	c.m[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size
+	for c.lru.Len() > 0 && ((c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries) || (c.MaxBytes > 0 && c.bytes > c.MaxBytes)) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes el. The caller must hold c.mu.
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.m, e.key)
+	c.bytes -= e.size
+}
+
+type recordingIterator struct {
+	c      *Cache
+	key    string
+	it     Iterator
+	chunks []*genai.GenerateContentResponse
+	size   int
+	finish genai.FinishReason // of the last chunk that gave one
+	failed bool
+	stored bool
+}
+
+func (r *recordingIterator) Next() (*genai.GenerateContentResponse, error) {
+	resp, err := r.it.Next()
+	switch {
+	case err == iterator.Done:
+		// only complete answers are replayed, not blocked, truncated or empty ones
+		if !r.failed && !r.stored && r.finish == genai.FinishReasonStop && r.size > 0 {
+			r.c.put(&cacheEntry{key: r.key, chunks: r.chunks, merged: r.it.MergedResponse(), size: r.size})
+			r.stored = true
+		}
+	case err != nil:
+		r.failed = true
+	default:
+		r.chunks = append(r.chunks, resp)
+		r.size += len(Text(resp))
+		for _, cand := range resp.Candidates {
+			if cand.FinishReason != genai.FinishReasonUnspecified {
+				r.finish = cand.FinishReason
+			}
+		}
+	}
+	return resp, err
+}
+
+func (r *recordingIterator) MergedResponse() *genai.GenerateContentResponse {
+	return r.it.MergedResponse()
+}
+
+type replayIterator struct {
+	e *cacheEntry
+	i int
+}
+
+func (r *replayIterator) Next() (*genai.GenerateContentResponse, error) {
+	if r.i >= len(r.e.chunks) {
+		return nil, iterator.Done
+	}
+	r.i++
+	return r.e.chunks[r.i-1], nil
+}
+
+func (r *replayIterator) MergedResponse() *genai.GenerateContentResponse {
+	if r.i < len(r.e.chunks) {
+		return nil
+	}
+	return r.e.merged
+}
@@ -0,0 +1,85 @@
+package gen
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+func TestCacheLimits(t *testing.T) {
+	stream := func(c *Cache, key, text string) bool {
+		it, hit := c.Stream(key, func() Iterator {
+			return (&Fake{Reply: func(Call) []string { return []string{text} }}).NewGenerator().GenerateContentStream(context.Background())
+		})
+		for {
+			if _, err := it.Next(); err != nil {
+				break
+			}
+		}
+		return hit
+	}
+
+	c := NewCache(time.Hour, 2, 10)
+	stream(c, "a", "1234")
+	stream(c, "b", "1234")
+	stream(c, "a", "")     // a is now most recently used
+	stream(c, "c", "1234") // evicts b, the least recently used
+	if c.Len() != 2 || !stream(c, "a", "") || stream(c, "b", "") {
+		t.Errorf("entry limit: len %d", c.Len())
+	}
+	stream(c, "big", "12345678901") // larger than the cache
+	if stream(c, "big", "") {
+		t.Error("oversize response should not be cached")
+	}
+
+	c = NewCache(time.Millisecond, 10, 100)
+	stream(c, "a", "x")
+	time.Sleep(5 * time.Millisecond)
+	if stream(c, "a", "x") {
+		t.Error("entry should have expired")
+	}
+}
+
+// sliceIterator streams the given chunks.
+type sliceIterator []*genai.GenerateContentResponse
+
+func (s *sliceIterator) Next() (*genai.GenerateContentResponse, error) {
+	if len(*s) == 0 {
+		return nil, iterator.Done
+	}
+	resp := (*s)[0]
+	*s = (*s)[1:]
+	return resp, nil
+}
+
+func (s *sliceIterator) MergedResponse() *genai.GenerateContentResponse { return nil }
+
+func TestCacheIncomplete(t *testing.T) {
+	c := NewCache(time.Hour, 10, 1000)
+	for _, tc := range []struct {
+		name   string
+		chunks []*genai.GenerateContentResponse
+	}{
+		{"Blocked", []*genai.GenerateContentResponse{textResponse("I cannot", genai.FinishReasonUnspecified), textResponse("", genai.FinishReasonSafety)}},
+		{"Recitation", []*genai.GenerateContentResponse{textResponse("Daisy, Daisy", genai.FinishReasonRecitation)}},
+		{"Truncated", []*genai.GenerateContentResponse{textResponse("once upon", genai.FinishReasonMaxTokens)}},
+		{"Empty", []*genai.GenerateContentResponse{textResponse("", genai.FinishReasonStop)}},
+		{"Unfinished", []*genai.GenerateContentResponse{textResponse("once upon", genai.FinishReasonUnspecified)}},
+	} {
+		it, _ := c.Stream(tc.name, func() Iterator {
+			s := sliceIterator(tc.chunks)
+			return &s
+		})
+		for {
+			if _, err := it.Next(); err != nil {
+				break
+			}
+		}
+		if _, hit := c.Stream(tc.name, func() Iterator { return &sliceIterator{} }); hit {
+			t.Errorf("%s: response should not be cached", tc.name)
+		}
+	}
+}
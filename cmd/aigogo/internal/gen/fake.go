@@ -0,0 +1,209 @@
+package gen
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+// Fake is a deterministic, scripted Backend for use without network access.
+// Every call is recorded and can be inspected with Calls.
+type Fake struct {
+	// Reply returns the chunks to respond with. A non-streaming call receives the chunks joined.
+	// If nil, the fake echoes the prompt as "fake response: <prompt>".
+	Reply func(c Call) []string
+	// Fail, if set, returns the error a call fails with, or nil to reply.
+	// A stream fails on its first Next.
+	Fail func(c Call) error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Call records a generation request received by a Fake.
+type Call struct {
+	SystemInstruction string
+	Prompt            string // text parts joined with newlines. Blobs are shown as [blob mime-type n bytes].
+	Parts             []genai.Part
+	Stream            bool
+	History           []*genai.Content // earlier turns of a chat
+}
+
+// NewGenerator returns a Generator recording into f.
+func (f *Fake) NewGenerator() Generator {
+	return &fakeGenerator{f: f}
+}
+
+// Close is a no-op.
+func (f *Fake) Close() error { return nil }
+
+// Calls returns a copy of the calls received so far.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call{}, f.calls...)
+}
+
+// Reset clears the recorded calls.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func (f *Fake) record(c Call) ([]string, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, c)
+	f.mu.Unlock()
+
+	if f.Fail != nil {
+		if err := f.Fail(c); err != nil {
+			return nil, err
+		}
+	}
+	if f.Reply != nil {
+		return f.Reply(c), nil
+	}
+	return []string{"fake response: ", c.Prompt}, nil
+}
+
+type fakeGenerator struct {
+	f   *Fake
+	sys string
+}
+
+// Model returns "fake".
+func (g *fakeGenerator) Model() string {
+	return "fake"
+}
+
+func (g *fakeGenerator) SetSystemInstruction(s string) {
+	g.sys = s
+}
+
+func (g *fakeGenerator) GenerateContent(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c := g.call(parts, false)
+	chunks, err := g.f.record(c)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.Join(chunks, "")
+	resp := textResponse(text, genai.FinishReasonStop)
+	resp.UsageMetadata = usage(c, text)
+	return resp, nil
+}
+
+func (g *fakeGenerator) GenerateContentStream(ctx context.Context, parts ...genai.Part) Iterator {
+	c := g.call(parts, true)
+	chunks, err := g.f.record(c)
+	return &fakeIterator{ctx: ctx, call: c, chunks: chunks, err: err}
+}
+
+func (g *fakeGenerator) StartChat(history []*genai.Content) Chat {
+	return &fakeChat{g: g, history: append([]*genai.Content{}, history...)}
+}
+
+type fakeChat struct {
+	g       *fakeGenerator
+	history []*genai.Content
+}
+
+func (c *fakeChat) SendMessageStream(ctx context.Context, parts ...genai.Part) Iterator {
+	call := c.g.call(parts, true)
+	call.History = append([]*genai.Content{}, c.history...)
+	c.history = append(c.history, genai.NewUserContent(parts...))
+	chunks, err := c.g.f.record(call)
+	it := &fakeIterator{ctx: ctx, call: call, chunks: chunks, err: err}
+	it.done = func(merged string) {
+		c.history = append(c.history, &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(merged)}})
+	}
+	return it
+}
+
+func (c *fakeChat) History() []*genai.Content {
+	return c.history
+}
+
+func (g *fakeGenerator) call(parts []genai.Part, stream bool) Call {
+	p := []string{}
+	for _, part := range parts {
+		switch v := part.(type) {
+		case genai.Text:
+			p = append(p, string(v))
+		case genai.Blob:
+			p = append(p, fmt.Sprintf("[blob %s %d bytes]", v.MIMEType, len(v.Data)))
+		default:
+			p = append(p, fmt.Sprintf("[%T]", v))
+		}
+	}
+	return Call{SystemInstruction: g.sys, Prompt: strings.Join(p, "\n"), Parts: parts, Stream: stream}
+}
+
+type fakeIterator struct {
+	ctx    context.Context
+	call   Call
+	chunks []string
+	i      int
+	merged string
+	err    error               // returned by every Next
+	done   func(merged string) // called once when the stream completes
+}
+
+func (it *fakeIterator) Next() (*genai.GenerateContentResponse, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.i >= len(it.chunks) {
+		if it.done != nil {
+			it.done(it.merged)
+			it.done = nil
+		}
+		return nil, iterator.Done
+	}
+	c := it.chunks[it.i]
+	it.i++
+	it.merged += c
+
+	if it.i < len(it.chunks) {
+		return textResponse(c, genai.FinishReasonUnspecified), nil
+	}
+	resp := textResponse(c, genai.FinishReasonStop)
+	resp.UsageMetadata = usage(it.call, it.merged)
+	return resp, nil
+}
+
+func (it *fakeIterator) MergedResponse() *genai.GenerateContentResponse {
+	if it.i == 0 {
+		return nil
+	}
+	return textResponse(it.merged, genai.FinishReasonStop)
+}
+
+// usage counts whitespace separated words as tokens.
+func usage(c Call, text string) *genai.UsageMetadata {
+	p := int32(len(strings.Fields(c.SystemInstruction)) + len(strings.Fields(c.Prompt)))
+	for _, h := range c.History {
+		p += int32(len(strings.Fields(ContentText(h))))
+	}
+	n := int32(len(strings.Fields(text)))
+	return &genai.UsageMetadata{PromptTokenCount: p, CandidatesTokenCount: n, TotalTokenCount: p + n}
+}
+
+func textResponse(s string, fr genai.FinishReason) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(s)}},
+			FinishReason: fr,
+		}},
+	}
+}
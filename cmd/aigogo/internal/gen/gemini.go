@@ -0,0 +1,68 @@
+package gen
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Gemini is a Backend using Google's Gemini models.
+type Gemini struct {
+	Client         *genai.Client
+	ModelName      string
+	SafetySettings []*genai.SafetySetting
+	Temperature    float32
+}
+
+// NewGenerator returns a Generator with its own copy of the model configuration.
+func (g *Gemini) NewGenerator() Generator {
+	m := g.Client.GenerativeModel(g.ModelName)
+	m.SafetySettings = g.SafetySettings
+	temp := g.Temperature
+	m.GenerationConfig.Temperature = &temp
+	return &geminiGenerator{m: m, name: g.ModelName}
+}
+
+// Close closes the underlying client.
+func (g *Gemini) Close() error {
+	return g.Client.Close()
+}
+
+type geminiGenerator struct {
+	m    *genai.GenerativeModel
+	name string
+}
+
+func (g *geminiGenerator) Model() string {
+	return g.name
+}
+
+func (g *geminiGenerator) SetSystemInstruction(s string) {
+	g.m.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(s)}}
+}
+
+func (g *geminiGenerator) GenerateContent(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	return g.m.GenerateContent(ctx, parts...)
+}
+
+func (g *geminiGenerator) GenerateContentStream(ctx context.Context, parts ...genai.Part) Iterator {
+	return g.m.GenerateContentStream(ctx, parts...)
+}
+
+func (g *geminiGenerator) StartChat(history []*genai.Content) Chat {
+	cs := g.m.StartChat()
+	cs.History = append([]*genai.Content{}, history...)
+	return &geminiChat{cs: cs}
+}
+
+type geminiChat struct {
+	cs *genai.ChatSession
+}
+
+func (c *geminiChat) SendMessageStream(ctx context.Context, parts ...genai.Part) Iterator {
+	return c.cs.SendMessageStream(ctx, parts...)
+}
+
+func (c *geminiChat) History() []*genai.Content {
+	return c.cs.History
+}
@@ -0,0 +1,63 @@
+// Package gen provides a backend neutral interface to generative models.
+package gen
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Backend creates request-scoped Generators.
+type Backend interface {
+	NewGenerator() Generator
+	Close() error
+}
+
+// Generator generates content for a single request.
+// A Generator is not safe for concurrent use, get a new one from a Backend for each request.
+type Generator interface {
+	Model() string // name of the model generating content
+	SetSystemInstruction(s string)
+	GenerateContent(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error)
+	GenerateContentStream(ctx context.Context, parts ...genai.Part) Iterator
+	StartChat(history []*genai.Content) Chat
+}
+
+// Chat is a multi-turn conversation with the Generator that started it.
+// The message sent is appended to History, and so is the reply once the stream completes.
+type Chat interface {
+	SendMessageStream(ctx context.Context, parts ...genai.Part) Iterator
+	History() []*genai.Content
+}
+
+// Iterator iterates over a streamed response. Next returns iterator.Done when the stream ends.
+type Iterator interface {
+	Next() (*genai.GenerateContentResponse, error)
+	MergedResponse() *genai.GenerateContentResponse
+}
+
+// Text returns the concatenated text parts of all candidates in resp.
+func Text(resp *genai.GenerateContentResponse) string {
+	if resp == nil {
+		return ""
+	}
+	s := ""
+	for _, cand := range resp.Candidates {
+		s += ContentText(cand.Content)
+	}
+	return s
+}
+
+// ContentText returns the concatenated text parts of c.
+func ContentText(c *genai.Content) string {
+	if c == nil {
+		return ""
+	}
+	s := ""
+	for _, part := range c.Parts {
+		if t, ok := part.(genai.Text); ok {
+			s += string(t)
+		}
+	}
+	return s
+}
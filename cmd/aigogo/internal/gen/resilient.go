@@ -0,0 +1,341 @@
+package gen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrUnavailable is returned, wrapping the last error, when no backend of a
+// Resilient could complete a call.
+var ErrUnavailable = errors.New("model unavailable")
+
+// Policy configures how a Resilient calls its backends.
+type Policy struct {
+	Timeout         time.Duration // per attempt, 0 for none. A stream must complete within it.
+	Retries         int           // further attempts per backend after a retryable error
+	Backoff         time.Duration // first retry delay, doubled for each further retry, with jitter
+	BreakerFailures int           // consecutive failures that open a backend's circuit, 0 disables the breaker
+	BreakerCooldown time.Duration // how long an open circuit rejects calls before a trial call
+}
+
+// Resilient is a Backend that calls an ordered list of backends: the first is
+// the primary and the rest are fallbacks, used when the ones before them fail
+// with retryable errors or have their circuit open.
+//
+// A stream is retried only until its first chunk, after which errors are
+// returned to the caller as they are.
+type Resilient struct {
+	Policy   Policy
+	backends []Backend
+	breakers []*breaker
+}
+
+// NewResilient returns a Resilient over backends, in order of preference.
+func NewResilient(p Policy, backends ...Backend) *Resilient {
+	r := &Resilient{Policy: p, backends: backends}
+	for range backends {
+		r.breakers = append(r.breakers, &breaker{})
+	}
+	return r
+}
+
+// NewGenerator returns a Generator that creates a generator of each backend as needed.
+func (r *Resilient) NewGenerator() Generator {
+	return &resilientGenerator{r: r, gens: make([]Generator, len(r.backends))}
+}
+
+// Close closes every backend and returns the first error.
+func (r *Resilient) Close() error {
+	var first error
+	for _, b := range r.backends {
+		if err := b.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Retryable reports whether err is a transient failure worth retrying, eg.
+// rate limiting, an overloaded or unavailable service, or an attempt timeout.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		switch ge.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Internal, codes.Aborted:
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before retry n (from 0): Backoff doubled n times,
+// give or take half.
+func (p Policy) backoff(n int) time.Duration {
+	d := p.Backoff << n
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d))) + d/2
+}
+
+func (p Policy) sleep(ctx context.Context, n int) error {
+	t := time.NewTimer(p.backoff(n))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (p Policy) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+// breaker is a circuit breaker. It opens after BreakerFailures consecutive
+// failures and then rejects calls for BreakerCooldown, after which one trial
+// call is let through: success closes the circuit and failure opens it again.
+type breaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero when closed
+	trial    bool      // a trial call is in progress
+}
+
+func (b *breaker) allow(p Policy) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p.BreakerFailures <= 0 || b.openedAt.IsZero() {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < p.BreakerCooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures, b.openedAt, b.trial = 0, time.Time{}, false
+}
+
+func (b *breaker) failure(p Policy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if p.BreakerFailures > 0 && (b.trial || b.failures >= p.BreakerFailures) {
+		b.openedAt = time.Now()
+	}
+	b.trial = false
+}
+
+// abort ends a call that gave no verdict on the backend, eg. one the caller
+// cancelled, letting another trial call through if the circuit is half-open.
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// attempt is one try of a call on backend i.
+type attempt func(ctx context.Context, i int) error
+
+// do tries each backend in turn until one succeeds, retrying retryable errors.
+// It returns the index of the backend that succeeded.
+func (r *Resilient) do(ctx context.Context, try attempt) (int, error) {
+	var last error
+	for i := range r.backends {
+		b := r.breakers[i]
+		if !b.allow(r.Policy) {
+			last = fmt.Errorf("backend %d: circuit open", i)
+			continue
+		}
+		for n := 0; ; n++ {
+			err := try(ctx, i)
+			if err == nil {
+				b.success()
+				return i, nil
+			}
+			if ctx.Err() != nil {
+				b.abort()
+				return i, err // the caller gave up
+			}
+			if !Retryable(err) {
+				b.success() // the backend answered, the request was at fault
+				return i, err
+			}
+			last = err
+			if n >= r.Policy.Retries {
+				b.failure(r.Policy)
+				break
+			}
+			log.Printf("retrying backend %d after: %v", i, err)
+			if err := r.Policy.sleep(ctx, n); err != nil {
+				b.abort()
+				return i, err
+			}
+		}
+		if i+1 < len(r.backends) {
+			log.Printf("falling back from backend %d after: %v", i, last)
+		}
+	}
+	return 0, fmt.Errorf("%w: %v", ErrUnavailable, last)
+}
+
+type resilientGenerator struct {
+	r    *Resilient
+	sys  *string
+	gens []Generator
+	used int // index of the backend that served the last call
+}
+
+func (g *resilientGenerator) gen(i int) Generator {
+	if g.gens[i] == nil {
+		g.gens[i] = g.r.backends[i].NewGenerator()
+		if g.sys != nil {
+			g.gens[i].SetSystemInstruction(*g.sys)
+		}
+	}
+	return g.gens[i]
+}
+
+// Model returns the model that served the last call, or the primary model.
+func (g *resilientGenerator) Model() string {
+	return g.gen(g.used).Model()
+}
+
+func (g *resilientGenerator) SetSystemInstruction(s string) {
+	g.sys = &s
+	for _, gn := range g.gens {
+		if gn != nil {
+			gn.SetSystemInstruction(s)
+		}
+	}
+}
+
+func (g *resilientGenerator) GenerateContent(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	var resp *genai.GenerateContentResponse
+	i, err := g.r.do(ctx, func(ctx context.Context, i int) error {
+		actx, cancel := g.r.Policy.attemptContext(ctx)
+		defer cancel()
+		var err error
+		resp, err = g.gen(i).GenerateContent(actx, parts...)
+		return err
+	})
+	g.used = i
+	return resp, err
+}
+
+func (g *resilientGenerator) GenerateContentStream(ctx context.Context, parts ...genai.Part) Iterator {
+	return &resilientIterator{r: g.r, ctx: ctx, start: func(ctx context.Context, i int) Iterator {
+		g.used = i
+		return g.gen(i).GenerateContentStream(ctx, parts...)
+	}}
+}
+
+func (g *resilientGenerator) StartChat(history []*genai.Content) Chat {
+	return &resilientChat{g: g, history: append([]*genai.Content{}, history...)}
+}
+
+// resilientChat starts a fresh chat from the history for every attempt, so
+// that a failed attempt leaves no turns behind.
+type resilientChat struct {
+	g       *resilientGenerator
+	history []*genai.Content
+	chat    Chat // of the attempt that streamed
+}
+
+func (c *resilientChat) SendMessageStream(ctx context.Context, parts ...genai.Part) Iterator {
+	return &resilientIterator{r: c.g.r, ctx: ctx, start: func(ctx context.Context, i int) Iterator {
+		c.g.used = i
+		c.chat = c.g.gen(i).StartChat(c.history)
+		return c.chat.SendMessageStream(ctx, parts...)
+	}}
+}
+
+func (c *resilientChat) History() []*genai.Content {
+	if c.chat == nil {
+		return c.history
+	}
+	return c.chat.History()
+}
+
+// resilientIterator starts its stream on the first call to Next, retrying
+// and falling back until a backend returns a first chunk.
+type resilientIterator struct {
+	r      *Resilient
+	ctx    context.Context
+	start  func(ctx context.Context, i int) Iterator
+	it     Iterator
+	first  *genai.GenerateContentResponse // first chunk, not yet returned
+	cancel context.CancelFunc
+	err    error // from starting the stream
+}
+
+func (it *resilientIterator) Next() (*genai.GenerateContentResponse, error) {
+	if it.it == nil && it.err == nil {
+		_, it.err = it.r.do(it.ctx, func(ctx context.Context, i int) error {
+			actx, cancel := it.r.Policy.attemptContext(ctx)
+			s := it.start(actx, i)
+			resp, err := s.Next()
+			if err != nil && err != iterator.Done {
+				cancel()
+				return err
+			}
+			it.it, it.first, it.cancel = s, resp, cancel
+			return nil
+		})
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.first != nil {
+		resp := it.first
+		it.first = nil
+		return resp, nil
+	}
+	resp, err := it.it.Next()
+	if err != nil {
+		it.cancel()
+	}
+	return resp, err
+}
+
+func (it *resilientIterator) MergedResponse() *genai.GenerateContentResponse {
+	if it.it == nil {
+		return nil
+	}
+	return it.it.MergedResponse()
+}
@@ -0,0 +1,145 @@
+package gen
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// read returns the text of a stream of r.
+func read(ctx context.Context, r *Resilient) (string, error) {
+	it := r.NewGenerator().GenerateContentStream(ctx)
+	var b strings.Builder
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			return b.String(), nil
+		}
+		if err != nil {
+			return b.String(), err
+		}
+		b.WriteString(ContentText(resp.Candidates[0].Content))
+	}
+}
+
+func TestResilience(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "overloaded")
+	policy := Policy{Retries: 1, Backoff: time.Millisecond}
+	ctx := context.Background()
+	hi := func(Call) []string { return []string{"hi"} }
+
+	t.Run("Retry", func(t *testing.T) {
+		n := 0
+		f := &Fake{
+			Reply: hi,
+			Fail: func(Call) error {
+				if n++; n == 1 {
+					return unavailable
+				}
+				return nil
+			},
+		}
+		if got, err := read(ctx, NewResilient(policy, f)); got != "hi" || len(f.Calls()) != 2 {
+			t.Errorf("got %q %v after %d calls", got, err, len(f.Calls()))
+		}
+	})
+
+	t.Run("NotRetryable", func(t *testing.T) {
+		f := &Fake{Fail: func(Call) error { return status.Error(codes.InvalidArgument, "bad request") }}
+		if _, err := read(ctx, NewResilient(policy, f)); err == nil || !strings.Contains(err.Error(), "bad request") || len(f.Calls()) != 1 {
+			t.Errorf("got %v after %d calls", err, len(f.Calls()))
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		n := 0
+		f := &Fake{
+			Reply: hi,
+			Fail: func(Call) error {
+				if n++; n == 1 {
+					time.Sleep(20 * time.Millisecond)
+				}
+				return nil
+			},
+		}
+		p := policy
+		p.Timeout = 10 * time.Millisecond
+		if got, err := read(ctx, NewResilient(p, f)); got != "hi" || len(f.Calls()) != 2 {
+			t.Errorf("slow attempt should be retried: got %q %v after %d calls", got, err, len(f.Calls()))
+		}
+	})
+
+	t.Run("FallbackAndBreaker", func(t *testing.T) {
+		primary := &Fake{Fail: func(Call) error { return unavailable }}
+		fallback := &Fake{Reply: func(Call) []string { return []string{"from fallback"} }}
+		p := policy
+		p.BreakerFailures, p.BreakerCooldown = 1, time.Hour
+		r := NewResilient(p, primary, fallback)
+		if got, _ := read(ctx, r); got != "from fallback" || len(primary.Calls()) != 2 {
+			t.Errorf("got %q after %d primary calls", got, len(primary.Calls()))
+		}
+		if got, _ := read(ctx, r); got != "from fallback" || len(primary.Calls()) != 2 {
+			t.Errorf("open circuit should skip the primary: got %q after %d primary calls", got, len(primary.Calls()))
+		}
+		resp, err := r.NewGenerator().GenerateContent(ctx)
+		if err != nil || ContentText(resp.Candidates[0].Content) != "from fallback" {
+			t.Errorf("non-streaming calls should fall back: %v", err)
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		f := &Fake{Fail: func(Call) error { return unavailable }}
+		if _, err := read(ctx, NewResilient(policy, f)); !errors.Is(err, ErrUnavailable) || len(f.Calls()) != 2 {
+			t.Errorf("got %v after %d calls", err, len(f.Calls()))
+		}
+	})
+
+	t.Run("HalfOpenCancelled", func(t *testing.T) {
+		var fail func(Call) error
+		f := &Fake{Reply: hi, Fail: func(c Call) error { return fail(c) }}
+		p := policy
+		p.BreakerFailures, p.BreakerCooldown = 1, time.Millisecond
+		r := NewResilient(p, f)
+		halfOpen := func() {
+			fail = func(Call) error { return unavailable }
+			read(ctx, r) // opens the circuit
+			time.Sleep(5 * time.Millisecond)
+		}
+		healthy := func(t *testing.T) {
+			fail = func(Call) error { return nil }
+			if got, err := read(ctx, r); got != "hi" {
+				t.Errorf("a cancelled trial call should let another through: got %q %v", got, err)
+			}
+		}
+
+		t.Run("DuringAttempt", func(t *testing.T) {
+			halfOpen()
+			cctx, cancel := context.WithCancel(ctx)
+			fail = func(Call) error { cancel(); return context.Canceled }
+			if _, err := read(cctx, r); !errors.Is(err, context.Canceled) {
+				t.Errorf("trial call: %v", err)
+			}
+			healthy(t)
+		})
+
+		t.Run("DuringBackoff", func(t *testing.T) {
+			halfOpen()
+			p := r.Policy
+			r.Policy.Backoff = time.Hour
+			t.Cleanup(func() { r.Policy = p })
+			tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			if _, err := read(tctx, r); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("trial call: %v", err)
+			}
+			r.Policy = p
+			healthy(t)
+		})
+	})
+}
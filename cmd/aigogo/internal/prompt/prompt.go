@@ -0,0 +1,153 @@
+// Package prompt renders the system instructions and prompts sent to the model
+// from versioned text/template files.
+//
+// A template file is named <name>.tmpl and starts with its version:
+//
+//	{{- /* version: 3 */ -}}
+//
+// Templates are rendered with Vars, eg. {{.Location}} or {{range .Resources}}.
+package prompt
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var embedded embed.FS
+
+// Vars are the named variables available to templates.
+type Vars struct {
+	Resources   []string // retrieved documents
+	RandomWords []string
+	Time        string
+	Timezone    string
+	Location    string
+	Weather     string // forecast JSON
+	Names       string // custom names to help transcription
+	Text        string // text to work on, eg. to summarize
+}
+
+var funcs = template.FuncMap{
+	"inc":  func(i int) int { return i + 1 },
+	"join": strings.Join,
+}
+
+var versionRE = regexp.MustCompile(`^\{\{-?\s*/\*\s*version:\s*([^\s*]+)\s*\*/\s*-?\}\}`)
+
+// Template is a parsed, versioned prompt template.
+type Template struct {
+	Name    string
+	Version string
+	Source  string // "embedded" or the file path it was loaded from
+	t       *template.Template
+}
+
+// ID identifies the template and version, eg. "caregiver@3".
+func (t *Template) ID() string {
+	return t.Name + "@" + t.Version
+}
+
+// Render executes t with v.
+func (t *Template) Render(v Vars) (string, error) {
+	var b strings.Builder
+	if err := t.t.Execute(&b, v); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Parse parses a template named name from text.
+// The template is test rendered with empty Vars to catch unknown variables.
+func Parse(name, text string) (*Template, error) {
+	m := versionRE.FindStringSubmatch(text)
+	if m == nil {
+		return nil, fmt.Errorf("%s: missing {{/* version: ... */}} header", name)
+	}
+	t, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	tm := &Template{Name: name, Version: m[1], t: t}
+	if _, err := tm.Render(Vars{}); err != nil {
+		return nil, err
+	}
+	return tm, nil
+}
+
+// Registry holds templates by name.
+type Registry struct {
+	m map[string]*Template
+}
+
+// Load parses the embedded templates. Any *.tmpl files in dir, if dir is not
+// empty, replace the embedded templates of the same name or add new ones.
+func Load(dir string) (*Registry, error) {
+	r := &Registry{m: map[string]*Template{}}
+	if err := r.addFS(embedded, "templates", "embedded"); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return r, nil
+	}
+	if err := r.addFS(os.DirFS(dir), ".", dir); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) addFS(fsys fs.FS, dir, source string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, fn := range files {
+		b, err := fs.ReadFile(fsys, fn)
+		if err != nil {
+			return err
+		}
+		t, err := Parse(strings.TrimSuffix(path.Base(fn), ".tmpl"), string(b))
+		if err != nil {
+			return err
+		}
+		t.Source = source
+		if source != "embedded" {
+			t.Source = path.Join(source, path.Base(fn))
+		}
+		r.m[t.Name] = t
+	}
+	return nil
+}
+
+// Get returns the template called name.
+func (r *Registry) Get(name string) (*Template, bool) {
+	t, ok := r.m[name]
+	return t, ok
+}
+
+// Render renders the template called name and returns the text with the template ID.
+func (r *Registry) Render(name string, v Vars) (text, id string, err error) {
+	t, ok := r.m[name]
+	if !ok {
+		return "", "", fmt.Errorf("no prompt template called %s", name)
+	}
+	text, err = t.Render(v)
+	return text, t.ID(), err
+}
+
+// Templates returns all templates sorted by name.
+func (r *Registry) Templates() []*Template {
+	s := []*Template{}
+	for _, t := range r.m {
+		s = append(s, t)
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].Name < s[j].Name })
+	return s
+}
@@ -0,0 +1,72 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmbedded(t *testing.T) {
+	r, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"caregiver", "philosopher", "memories", "transcribe", "summarize"} {
+		tm, ok := r.Get(name)
+		if !ok || tm.Version == "" || tm.Source != "embedded" {
+			t.Errorf("%s: %+v", name, tm)
+		}
+	}
+
+	s, id, err := r.Render("caregiver", Vars{Resources: []string{"a | one", "b | two"}, Location: "Clementi", RandomWords: []string{"x", "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "caregiver@1" {
+		t.Errorf("id: %s", id)
+	}
+	for _, want := range []string{"Below are 2 RESOURCES", "RESOURCE 1: a | one", "RESOURCE 2: b | two", "location: Clementi", "RANDOM WORDS: [x y]"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in:\n%s", want, s)
+		}
+	}
+	if s, _, _ := r.Render("caregiver", Vars{}); !strings.Contains(s, "There are no RESOURCES") {
+		t.Errorf("no resources:\n%s", s)
+	}
+	if _, _, err := r.Render("nope", Vars{}); err == nil {
+		t.Error("unknown template should be an error")
+	}
+}
+
+func TestOverride(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "philosopher.tmpl"), []byte("{{- /* version: 2-beta */ -}}\nMeaning at {{.Location}}."), 0644)
+	os.WriteFile(filepath.Join(dir, "extra.tmpl"), []byte("{{/* version: 1 */}}hi"), 0644)
+	r, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, id, _ := r.Render("philosopher", Vars{Location: "Ipoh"})
+	if s != "Meaning at Ipoh." || id != "philosopher@2-beta" {
+		t.Errorf("override: %q %s", s, id)
+	}
+	if _, ok := r.Get("extra"); !ok {
+		t.Error("new template not loaded")
+	}
+	if tm, _ := r.Get("caregiver"); tm.Source != "embedded" {
+		t.Error("templates not on disk should stay embedded")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"NoVersion":  "hello {{.Location}}",
+		"UnknownVar": "{{/* version: 1 */}}hello {{.Nowhere}}",
+		"Syntax":     "{{/* version: 1 */}}hello {{.Location",
+	} {
+		if _, err := Parse(name, text); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
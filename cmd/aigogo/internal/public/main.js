@@ -23,6 +23,13 @@ const userPrompt = document.getElementById("userPrompt");
 const userSubmit = document.getElementById("userSubmit");
 userSubmit.addEventListener("click", retrieveDocsForAugmentation);
 
+// conversations are kept for signed in users, see the personal log page.
+const newConversationBtn = document.getElementById("newConversation");
+newConversationBtn.addEventListener("click", () => {
+    sessionStorage.removeItem("conv");
+    embeddingResponse.innerHTML = "";
+});
+
 // embeddingResponse is the main RAG response
 const embeddingResponse = document.getElementById("embeddingResponse");
 // modelResponse is the LLM model response
@@ -82,7 +89,11 @@ async function retrieveDocsForAugmentation() {
     let usrQry = encodeURIComponent(userPrompt.value);
     let ctx = encodeURIComponent(sessionStorage.getItem("context"));
     let weather = encodeURIComponent(sessionStorage.getItem("weatherForecastJSON"));
-    const url = `/retr?userPrompt=${usrQry}&loc=${loc}&latlng=${sessionStorage.getItem("latlng")}&ctx=${ctx}&weather=${weather}`;
+    let url = `/retr?userPrompt=${usrQry}&loc=${loc}&latlng=${sessionStorage.getItem("latlng")}&ctx=${ctx}&weather=${weather}`;
+    const userID = sessionStorage.getItem("userID");
+    if (userID) {
+        url += `&userID=${encodeURIComponent(userID)}&conv=${encodeURIComponent(sessionStorage.getItem("conv") ?? "new")}`;
+    }
 
     embeddingResponse.innerHTML = "working ... give me a few seconds ..."
     try {
@@ -141,16 +152,107 @@ async function meaningOfLifeStrm() {
     await streamToElement(modelResponse, url);
 }
 
+// streamToElement renders the server-sent events of url into el.
 async function streamToElement(el, url) {
-    const res = await fetch(url);
+    const res = await fetch(url, { headers: { "Accept": "text/event-stream" } });
+    if (res.status == 429) {
+        el.innerText = await res.text();
+        return;
+    }
+    if (res.status == 404 && sessionStorage.getItem("conv")) {
+        // the conversation has expired, start a new one
+        sessionStorage.removeItem("conv");
+        return streamToElement(el, url.replace(/&conv=[^&]*/, "&conv=new"));
+    }
     let tmp = "";
+    let srcs = [];
+    let notes = "";
+    let responseID = "";
     el.innerHTML = "";
     const dec = new TextDecoder("utf-8");
+    let buf = "";
     for await (const chunk of res.body) {
-        el.innerHTML += (dec.decode(chunk));
-        tmp += (dec.decode(chunk));
+        buf += dec.decode(chunk, { stream: true });
+        let i;
+        while ((i = buf.indexOf("\n\n")) >= 0) {
+            const ev = parseEvent(buf.slice(0, i));
+            buf = buf.slice(i + 2);
+            switch (ev.name) {
+                case "token":
+                case "debug":
+                    tmp += ev.data.text;
+                    el.innerText = tmp;
+                    break;
+                case "sources":
+                    srcs = ev.data;
+                    break;
+                case "response":
+                    responseID = ev.data.id;
+                    break;
+                case "conversation":
+                    sessionStorage.setItem("conv", ev.data.id);
+                    break;
+                case "safety":
+                    if (ev.data.blocked) { notes += "\n\n*Part of this answer was withheld for safety reasons.*" }
+                    break;
+                case "error":
+                    notes += `\n\n*Sorry, I've encountered an issue: ${ev.data.message}*`;
+                    break;
+            }
+        }
+    }
+    el.innerHTML = marked.parse(tmp + notes);
+    showSources(el, srcs);
+    showFeedback(el, responseID);
+}
+
+// showFeedback lets the user rate the response.
+function showFeedback(el, responseID) {
+    if (!responseID) { return }
+    const p = document.createElement("p");
+    for (const [label, rating] of [["👍", 1], ["👎", -1]]) {
+        const btn = document.createElement("button");
+        btn.innerText = label;
+        btn.addEventListener("click", async () => {
+            const body = new URLSearchParams({ responseID: responseID, rating: rating });
+            await fetch("/feedback", { method: "POST", body: body });
+            p.innerText = "Thank you for your feedback.";
+        });
+        p.appendChild(btn);
+    }
+    el.appendChild(p);
+}
+
+function parseEvent(blk) {
+    const ev = { name: "message", data: null };
+    for (const line of blk.split("\n")) {
+        if (line.startsWith("event: ")) { ev.name = line.slice(7) }
+        if (line.startsWith("data: ")) { ev.data = JSON.parse(line.slice(6)) }
+    }
+    return ev;
+}
+
+// showSources appends links to the knowledge base documents an answer was based on.
+function showSources(el, srcs) {
+    if (srcs.length == 0) { return }
+    const details = document.createElement("details");
+    const summary = document.createElement("summary");
+    summary.innerText = "Sources";
+    details.appendChild(summary);
+    const ul = document.createElement("ul");
+    for (const s of srcs) {
+        const li = document.createElement("li");
+        const a = document.createElement("a");
+        a.href = `/doc/${encodeURIComponent(s.id)}`;
+        a.target = "_blank";
+        a.innerText = s.title;
+        li.appendChild(a);
+        const sim = s.similarity === undefined ? "keyword match" : `similarity ${s.similarity.toFixed(2)}`;
+        li.append(` (${s.context}, ${sim})`);
+        ul.appendChild(li);
     }
-    el.innerHTML = marked.parse(tmp);
+    details.appendChild(ul);
+    el.appendChild(details);
 }
 
 function debugSelectedContext(ctx) {
@@ -62,6 +62,7 @@ async function fetchPersonalLogDetails(logBasename) {
         selectedLogEntry.innerHTML = `<div>${logDet.Date}:
         <p><span class="heading">summary:</span> ${logDet.Summary}</p >
             <p><span class="heading">transcript:</span> ${logDet.Transcript}</p>
+        ${metaDetails(logDet.Meta)}
         <p><audio controls src="data:audio/ogg;base64,${logDet.Audio}"></audio>
         </div > `;
     } catch (err) {
@@ -69,6 +70,28 @@ async function fetchPersonalLogDetails(logBasename) {
     }
 }
 
+// metaDetails renders the metadata of a log entry, if it has any.
+function metaDetails(meta) {
+    if (!meta) {
+        return "";
+    }
+    let out = "";
+    const field = (heading, value) => {
+        if (value) {
+            out += `<p><span class="heading">${heading}:</span> ${value}</p>`;
+        }
+    };
+    let location = meta.neighborhood ?? "";
+    if (meta.location) {
+        location += ` (${meta.location.lat}, ${meta.location.lng})`;
+    }
+    field("location", location.trim());
+    field("people", (meta.people ?? []).join(", "));
+    field("primary highlight", meta.primaryHighlight);
+    field("secondary highlight", meta.secondaryHighlight);
+    return out;
+}
+
 async function streamToElement(el, url) {
     const res = await fetch(url);
     let tmp = "";
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/bm25"
+	"github.com/siuyin/aigogo/rag"
+)
+
+// knowledgeBase indexes the rag documents held in the vector database collection.
+// chromem cannot list its documents, so the index is kept alongside the collection
+// and all writes go through the knowledge base. A keyword index of the same
+// documents supports hybrid retrieval.
+type knowledgeBase struct {
+	mu       sync.RWMutex
+	c        *chromem.Collection
+	docs     map[string]rag.Doc // without embeddings
+	keywords *bm25.Index
+}
+
+var kb *knowledgeBase
+
+// newKnowledgeBase indexes all documents in c.
+func newKnowledgeBase(c *chromem.Collection) *knowledgeBase {
+	k := &knowledgeBase{c: c, docs: map[string]rag.Doc{}, keywords: bm25.New()}
+	n := c.Count()
+	if n == 0 {
+		return k
+	}
+
+	// Any query vector of the right size returns every document when nResults is the collection size.
+	ctx := context.Background()
+	qv, err := emb.Embed(ctx, "knowledge base")
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := c.QueryEmbedding(ctx, qv, n, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range res {
+		k.docs[r.ID] = docFromResult(r)
+		k.keywords.Add(r.ID, r.Content)
+	}
+	return k
+}
+
+// chromemDoc converts d to a collection document. The embedding is left empty
+// for the collection to embed the title and content.
+func chromemDoc(d rag.Doc) chromem.Document {
+	m := map[string]string{}
+	for k, v := range d.Metadata {
+		m[k] = v
+	}
+	m["context"] = d.Context
+	m["title"] = d.Title
+	return chromem.Document{
+		ID:       d.ID,
+		Content:  d.Title + " | " + d.Content,
+		Metadata: m,
+	}
+}
+
+// docFromResult recovers a rag document from a collection entry. Entries imported
+// from embeddings.gob do not have the title metadata and are split on the first " | ".
+func docFromResult(r chromem.Result) rag.Doc {
+	d := rag.Doc{ID: r.ID, Context: r.Metadata["context"], Content: r.Content, EmbeddingModel: emb.Name()}
+	for k, v := range r.Metadata {
+		if k == "context" || k == "title" {
+			continue
+		}
+		if d.Metadata == nil {
+			d.Metadata = map[string]string{}
+		}
+		d.Metadata[k] = v
+	}
+	if t, ok := r.Metadata["title"]; ok {
+		d.Title = t
+		d.Content = strings.TrimPrefix(r.Content, t+" | ")
+		return d
+	}
+	if t, c, ok := strings.Cut(r.Content, " | "); ok {
+		d.Title, d.Content = t, c
+	}
+	return d
+}
+
+// list returns the documents in the given context, or all documents if context is empty, sorted by ID.
+func (k *knowledgeBase) list(context string) []rag.Doc {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	s := []rag.Doc{}
+	for _, d := range k.docs {
+		if context == "" || d.Context == context {
+			s = append(s, d)
+		}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].ID < s[j].ID })
+	return s
+}
+
+// count returns the number of documents whose context is exactly context.
+func (k *knowledgeBase) count(context string) int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	n := 0
+	for _, d := range k.docs {
+		if d.Context == context {
+			n++
+		}
+	}
+	return n
+}
+
+// ids returns the set of document IDs whose context is exactly context.
+func (k *knowledgeBase) ids(context string) map[string]bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	m := map[string]bool{}
+	for id, d := range k.docs {
+		if d.Context == context {
+			m[id] = true
+		}
+	}
+	return m
+}
+
+func (k *knowledgeBase) get(id string) (rag.Doc, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	d, ok := k.docs[id]
+	return d, ok
+}
+
+var (
+	errDocExists   = errors.New("document already exists")
+	errDocNotFound = errors.New("document not found")
+)
+
+// create stores d, or returns errDocExists if a document has its ID.
+func (k *knowledgeBase) create(ctx context.Context, d rag.Doc) (rag.Doc, error) {
+	return k.putIf(ctx, d, func(exists bool) error {
+		if exists {
+			return errDocExists
+		}
+		return nil
+	})
+}
+
+// update replaces the document with the ID of d, or returns errDocNotFound.
+func (k *knowledgeBase) update(ctx context.Context, d rag.Doc) (rag.Doc, error) {
+	return k.putIf(ctx, d, func(exists bool) error {
+		if !exists {
+			return errDocNotFound
+		}
+		return nil
+	})
+}
+
+// putIf embeds d and stores it if check, called with whether a document has
+// its ID, returns nil. The check and the store are atomic. d is embedded
+// before taking the lock so that a slow embedder does not hold up readers.
+func (k *knowledgeBase) putIf(ctx context.Context, d rag.Doc, check func(exists bool) error) (rag.Doc, error) {
+	_, exists := k.get(d.ID)
+	if err := check(exists); err != nil {
+		return rag.Doc{}, err // fail early, without embedding
+	}
+	cd := chromemDoc(d)
+	v, err := emb.Embed(ctx, cd.Content)
+	if err != nil {
+		return rag.Doc{}, err
+	}
+	cd.Embedding = v
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, exists = k.docs[d.ID]
+	if err := check(exists); err != nil {
+		return rag.Doc{}, err
+	}
+	if err := k.c.AddDocument(ctx, cd); err != nil {
+		return rag.Doc{}, err
+	}
+	d.Embedding = nil
+	d.EmbeddingModel = emb.Name()
+	k.docs[d.ID] = d
+	k.keywords.Add(d.ID, cd.Content)
+	return d, nil
+}
+
+func (k *knowledgeBase) delete(ctx context.Context, id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.c.Delete(ctx, nil, nil, id); err != nil {
+		return err
+	}
+	delete(k.docs, id)
+	k.keywords.Remove(id)
+	return nil
+}
+
+// ------------------------------------------------
+
+// requireKBToken only admits requests carrying "Authorization: Bearer <KB_TOKEN>".
+// The knowledge base API is disabled when KB_TOKEN is not set.
+func requireKBToken(h http.HandlerFunc) http.HandlerFunc {
+	return requireToken("KB_TOKEN", h)
+}
+
+// requireAdminToken guards the admin endpoints with ADMIN_TOKEN.
+func requireAdminToken(h http.HandlerFunc) http.HandlerFunc {
+	return requireToken("ADMIN_TOKEN", h)
+}
+
+// requireToken only admits requests carrying the bearer token in the env variable.
+func requireToken(env string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tok := os.Getenv(env)
+		if tok == "" {
+			http.Error(w, "API disabled: "+env+" not set", http.StatusForbidden)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(tok)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func kbListFunc(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, kb.list(r.FormValue("context")))
+}
+
+func kbGetFunc(w http.ResponseWriter, r *http.Request) {
+	d, ok := kb.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+func kbCreateFunc(w http.ResponseWriter, r *http.Request) {
+	d, ok := decodeKBDoc(w, r)
+	if !ok {
+		return
+	}
+	if d.ID == "" {
+		d.ID = fmt.Sprintf("kb-%d", time.Now().UnixNano())
+	}
+	kbPut(w, r, d, kb.create, http.StatusCreated)
+}
+
+func kbUpdateFunc(w http.ResponseWriter, r *http.Request) {
+	d, ok := decodeKBDoc(w, r)
+	if !ok {
+		return
+	}
+	d.ID = r.PathValue("id")
+	kbPut(w, r, d, kb.update, http.StatusOK)
+}
+
+func kbDeleteFunc(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, exists := kb.get(id); !exists {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+	if err := kb.delete(r.Context(), id); err != nil {
+		log.Printf("ERROR: could not delete document %s: %v", id, err)
+		http.Error(w, "could not delete document", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeKBDoc(w http.ResponseWriter, r *http.Request) (rag.Doc, bool) {
+	var d rag.Doc
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, "could not decode document: "+err.Error(), http.StatusBadRequest)
+		return d, false
+	}
+	if d.Title == "" || d.Content == "" || d.Context == "" {
+		http.Error(w, "Title, Content and Context required", http.StatusBadRequest)
+		return d, false
+	}
+	return d, true
+}
+
+// kbPut stores d with put and responds with status.
+func kbPut(w http.ResponseWriter, r *http.Request, d rag.Doc, put func(context.Context, rag.Doc) (rag.Doc, error), status int) {
+	stored, err := put(r.Context(), d)
+	switch {
+	case errors.Is(err, errDocExists):
+		http.Error(w, "document already exists: "+d.ID, http.StatusConflict)
+		return
+	case errors.Is(err, errDocNotFound):
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("ERROR: could not store document %s: %v", d.ID, err)
+		http.Error(w, "could not store document", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("knowledge base: stored %s: %s (%s)", d.ID, d.Title, d.Context)
+	writeJSON(w, status, stored)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siuyin/aigogo/logstore"
+)
+
+// logEntry is a personal log entry as listed by /logs.
+type logEntry struct {
+	Basename string         `json:"basename"`
+	Time     time.Time      `json:"time"`
+	Summary  string         `json:"summary"`
+	Meta     *logstore.Meta `json:"meta,omitempty"` // nil for entries saved before metadata files
+}
+
+// logPage is a page of log entries, newest first.
+type logPage struct {
+	Entries []logEntry `json:"entries"`
+	Total   int        `json:"total"`          // entries matching the query, on every page
+	Next    string     `json:"next,omitempty"` // pass as before to get the next page, empty on the last page
+}
+
+// logQuery selects log entries. Zero fields match every entry.
+type logQuery struct {
+	From, To     time.Time // To is exclusive
+	Primary      string    // primary highlight
+	Secondary    string    // secondary highlight
+	Highlight    string    // primary or secondary highlight
+	Neighborhood string    // part of the neighborhood
+	People       []string  // all of these people
+	Before       string    // only entries older than this basename
+	Limit        int
+}
+
+const (
+	defaultLogLimit = 20
+	maxLogLimit     = 100
+)
+
+// parseLogQuery reads a logQuery from the form values from and to (days,
+// eg. 2024-08-01, both inclusive, or RFC3339 times), primary, secondary,
+// highlight, neighborhood, people (comma separated), before and limit.
+func parseLogQuery(r *http.Request) (logQuery, error) {
+	q := logQuery{
+		Primary:      r.FormValue("primary"),
+		Secondary:    r.FormValue("secondary"),
+		Highlight:    r.FormValue("highlight"),
+		Neighborhood: r.FormValue("neighborhood"),
+		People:       logstore.ParsePeople(r.FormValue("people")),
+		Before:       r.FormValue("before"),
+		Limit:        defaultLogLimit,
+	}
+	var err error
+	if q.From, err = parseLogTime(r.FormValue("from"), false); err != nil {
+		return q, err
+	}
+	if q.To, err = parseLogTime(r.FormValue("to"), true); err != nil {
+		return q, err
+	}
+	if s := r.FormValue("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("bad limit: %s", s)
+		}
+		q.Limit = min(q.Limit, maxLogLimit)
+	}
+	return q, nil
+}
+
+// parseLogTime parses a day or an RFC3339 time. With end, it returns the
+// end of the day or the instant after the time, for an exclusive bound.
+func parseLogTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("bad time %q, want eg. 2024-08-01 or 2024-08-01T15:04:05Z", s)
+	}
+	if end {
+		t = t.Add(time.Nanosecond)
+	}
+	return t, nil
+}
+
+func (q logQuery) needsMeta() bool {
+	return q.Primary != "" || q.Secondary != "" || q.Highlight != "" || q.Neighborhood != "" || len(q.People) > 0
+}
+
+// matchTime reports whether an entry recorded at t is in q's date range.
+func (q logQuery) matchTime(t time.Time) bool {
+	return (q.From.IsZero() || !t.Before(q.From)) && (q.To.IsZero() || t.Before(q.To))
+}
+
+// matchMeta reports whether an entry with metadata m, nil if it has none, matches q.
+// Text is compared ignoring case.
+func (q logQuery) matchMeta(m *logstore.Meta) bool {
+	if !q.needsMeta() {
+		return true
+	}
+	if m == nil {
+		return false
+	}
+	eq := strings.EqualFold
+	switch {
+	case q.Primary != "" && !eq(m.PrimaryHighlight, q.Primary),
+		q.Secondary != "" && !eq(m.SecondaryHighlight, q.Secondary),
+		q.Highlight != "" && !eq(m.PrimaryHighlight, q.Highlight) && !eq(m.SecondaryHighlight, q.Highlight),
+		q.Neighborhood != "" && !strings.Contains(strings.ToLower(m.Neighborhood), strings.ToLower(q.Neighborhood)):
+		return false
+	}
+	for _, p := range q.People {
+		if !slices.ContainsFunc(m.People, func(s string) bool { return eq(s, p) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// requireLogToken only admits requests carrying "Authorization: Bearer <LOG_TOKEN>".
+// The personal log API is disabled when LOG_TOKEN is not set.
+func requireLogToken(h http.HandlerFunc) http.HandlerFunc {
+	return requireToken("LOG_TOKEN", h)
+}
+
+// logListFunc lists the summarized log entries of userID, newest first, that
+// match the query in the form values. See parseLogQuery.
+func logListFunc(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	basenames := personalLogEntries(r.Context(), userID)
+	slices.Reverse(basenames) // the basenames sort by time
+	page := logPage{Entries: []logEntry{}}
+	for _, bn := range basenames {
+		t, ok := logstore.EntryTime(bn)
+		if !ok || !q.matchTime(t) {
+			continue
+		}
+		older := q.Before == "" || bn < q.Before
+		onPage := older && len(page.Entries) < q.Limit
+		var meta *logstore.Meta
+		if q.needsMeta() || onPage {
+			if m, err := logs.GetMeta(r.Context(), userID, bn); err == nil {
+				meta = &m
+			}
+		}
+		if !q.matchMeta(meta) {
+			continue
+		}
+		page.Total++
+		if older && !onPage && page.Next == "" {
+			page.Next = page.Entries[q.Limit-1].Basename
+		}
+		if onPage {
+			page.Entries = append(page.Entries, logEntry{
+				Basename: bn, Time: t, Meta: meta,
+				Summary: getBody(r.Context(), userID, bn, logstore.Summary),
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// archiveTypes are the content types of the export formats.
+var archiveTypes = map[string]string{"zip": "application/zip", "tar": "application/x-tar"}
+
+// logExportFunc sends the personal log of userID as a zip, or with
+// format=tar a tar, archive. See logstore.Store.Export. The archive is built
+// in a temporary file first, so that a failure is reported as an error
+// rather than sent as a truncated archive.
+func logExportFunc(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "zip"
+	}
+	if !slices.Contains(logstore.Formats, format) {
+		http.Error(w, "format must be one of: "+strings.Join(logstore.Formats, ", "), http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.CreateTemp("", "aigogo-export-*")
+	if err != nil {
+		log.Printf("ERROR: could not create the export file: %v", err)
+		http.Error(w, "could not export the personal log", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = logs.Export(r.Context(), f, userID, format)
+	switch {
+	case errors.Is(err, logstore.ErrNotFound):
+		http.Error(w, "no personal log for "+userID, http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("ERROR: could not export the personal log of %s: %v", userID, err)
+		http.Error(w, "could not export the personal log", http.StatusInternalServerError)
+		return
+	}
+
+	fn := fmt.Sprintf("aigogo-%s-%s.%s", userID, time.Now().UTC().Format(time.DateOnly), format)
+	w.Header().Set("Content-Type", archiveTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fn+`"`)
+	http.ServeContent(w, r, fn, time.Time{}, f)
+	log.Printf("exported the personal log of %s", userID)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/philippgille/chromem-go"
+	"github.com/siuyin/aigogo/logstore"
+)
+
+// memoryEntryCount is the number of log entries memories are built from.
+const memoryEntryCount = 5
+
+// logIndex holds a vector collection per user of their summarized log
+// entries, for finding the entries relevant to a memories prompt. Entries are
+// added when saved. On each search, entries saved before, lost with an
+// in-memory database, or written to the log store by another process are
+// added, and entries deleted from the log store are removed.
+type logIndex struct {
+	mu    sync.Mutex
+	users map[string]*userLogIndex
+}
+
+type userLogIndex struct {
+	mu  sync.Mutex
+	c   *chromem.Collection
+	ids map[string]bool // entries in c, nil until the first sync
+}
+
+var logIdx = &logIndex{users: map[string]*userLogIndex{}}
+
+// logDB holds the log collections. It is kept apart from the knowledge base
+// so that private log entries are not stored with the public documents.
+var logDB *chromem.DB
+
+// initLogDB opens the database of log collections, persisted in the folder
+// LOG_VECDB_PATH if set, otherwise in memory and rebuilt as users search.
+func initLogDB() *chromem.DB {
+	path := os.Getenv("LOG_VECDB_PATH")
+	if path == "" {
+		return chromem.NewDB()
+	}
+	d, err := chromem.NewPersistentDB(path, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+// logCollectionName is the name of the collection of userID's log entries.
+func logCollectionName(userID string) string {
+	return collectionName() + "-logs-" + userID
+}
+
+// user returns the index of userID, creating its collection if needed.
+// Callers check that userID has log entries.
+func (x *logIndex) user(userID string) (*userLogIndex, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if u, ok := x.users[userID]; ok {
+		return u, nil
+	}
+	c, err := logDB.GetOrCreateCollection(logCollectionName(userID), nil, emb.Embed)
+	if err != nil {
+		return nil, err
+	}
+	u := &userLogIndex{c: c}
+	x.users[userID] = u
+	return u, nil
+}
+
+// logDocument returns the collection document of the log entry basename:
+// its summary, transcript and metadata.
+func logDocument(ctx context.Context, userID, basename string) (chromem.Document, error) {
+	d := chromem.Document{ID: basename}
+	sum, err := logs.Get(ctx, userID, basename, logstore.Summary)
+	if err != nil {
+		return d, err
+	}
+	tr, err := logs.Get(ctx, userID, basename, logstore.Transcript)
+	if err != nil && !errors.Is(err, logstore.ErrNotFound) {
+		return d, err
+	}
+	d.Content = string(sum) + "\n\n" + string(tr)
+	if m, err := logs.GetMeta(ctx, userID, basename); err == nil {
+		d.Content += "\n" + m.String()
+	}
+	return d, nil
+}
+
+// add embeds the log entry basename of userID, replacing any earlier version.
+func (x *logIndex) add(ctx context.Context, userID, basename string) error {
+	u, err := x.user(userID)
+	if err != nil {
+		return err
+	}
+	d, err := logDocument(ctx, userID, basename)
+	if err != nil {
+		return err
+	}
+	if d.Embedding, err = emb.Embed(ctx, d.Content); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.c.AddDocument(ctx, d); err != nil {
+		return err
+	}
+	if u.ids != nil {
+		u.ids[basename] = true
+	}
+	return nil
+}
+
+// sync makes the collection of userID hold exactly entries, the basenames of
+// the user's log entries, adding the missing and removing the deleted.
+func (x *logIndex) sync(ctx context.Context, userID string, entries []string) (*chromem.Collection, error) {
+	u, err := x.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ids == nil {
+		if err := u.load(ctx, userID, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	want := map[string]bool{}
+	docs := []chromem.Document{}
+	for _, bn := range entries {
+		want[bn] = true
+		if u.ids[bn] {
+			continue
+		}
+		d, err := logDocument(ctx, userID, bn)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	stale := []string{}
+	for bn := range u.ids {
+		if !want[bn] {
+			stale = append(stale, bn)
+		}
+	}
+	if len(stale) > 0 {
+		if err := u.c.Delete(ctx, nil, nil, stale...); err != nil {
+			return nil, err
+		}
+		for _, bn := range stale {
+			delete(u.ids, bn)
+		}
+		log.Printf("removed %d deleted log entries of %s", len(stale), userID)
+	}
+	if len(docs) > 0 {
+		if err := u.c.AddDocuments(ctx, docs, runtime.NumCPU()); err != nil {
+			return nil, err
+		}
+		for _, d := range docs {
+			u.ids[d.ID] = true
+		}
+		log.Printf("indexed %d log entries of %s", len(docs), userID)
+	}
+	return u.c, nil
+}
+
+// load finds which of entries a persisted collection already holds. chromem
+// cannot list documents, so if the collection also holds entries since
+// deleted, it is emptied for sync to rebuild.
+func (u *userLogIndex) load(ctx context.Context, userID string, entries []string) error {
+	u.ids = map[string]bool{}
+	for _, bn := range entries {
+		if _, err := u.c.GetByID(ctx, bn); err == nil {
+			u.ids[bn] = true
+		}
+	}
+	if u.c.Count() == len(u.ids) {
+		return nil
+	}
+	name := logCollectionName(userID)
+	if err := logDB.DeleteCollection(name); err != nil {
+		return err
+	}
+	c, err := logDB.GetOrCreateCollection(name, nil, emb.Embed)
+	if err != nil {
+		return err
+	}
+	u.c, u.ids = c, map[string]bool{}
+	return nil
+}
+
+// search returns the basenames of up to n log entries of userID most similar
+// to qry. Users without log entries get none, and no collection.
+func (x *logIndex) search(ctx context.Context, userID, qry string, n int) ([]string, error) {
+	entries := personalLogEntries(ctx, userID)
+	if len(entries) == 0 {
+		return []string{}, nil
+	}
+	c, err := x.sync(ctx, userID, entries)
+	if err != nil {
+		return nil, err
+	}
+	if n = min(n, c.Count()); n == 0 {
+		return []string{}, nil
+	}
+	qv, err := emb.Embed(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.QueryEmbedding(ctx, qv, n, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	bn := []string{}
+	for _, r := range res {
+		bn = append(bn, r.ID)
+	}
+	return bn, nil
+}
+
+// indexLogEntry adds a saved log entry to the user's collection. It is added
+// even if the client has gone away.
+func indexLogEntry(userID, basename string) {
+	ctx := context.Background()
+	if requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	if err := logIdx.add(ctx, userID, basename); err != nil {
+		log.Printf("WARNING: could not index %s of %s: %v", basename, userID, err)
+	}
+}
+
+// memoryEntries selects the log entries memories are built from: those most
+// relevant to the user's prompt or, without a prompt, a random selection.
+// A random selection is also used if the entries cannot be searched.
+func memoryEntries(r *http.Request) []string {
+	userID, qry := r.FormValue("userID"), strings.TrimSpace(r.FormValue("userPrompt"))
+	if userID == "" {
+		return []string{}
+	}
+	if qry != "" {
+		bn, err := logIdx.search(r.Context(), userID, qry, memoryEntryCount)
+		if err == nil {
+			return bn
+		}
+		log.Printf("WARNING: could not search the log entries of %s, using a random selection: %v", userID, err)
+	}
+	return randSelection(personalLogEntries(r.Context(), userID), memoryEntryCount)
+}
@@ -8,34 +8,37 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"io/fs"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/philippgille/chromem-go"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/gen"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/prompt"
 	"github.com/siuyin/aigogo/cmd/aigogo/internal/public"
 	"github.com/siuyin/aigogo/cmd/aigogo/internal/vecdb"
+	"github.com/siuyin/aigogo/embedder"
+	"github.com/siuyin/aigogo/logstore"
 	"github.com/siuyin/aigogo/rag"
 	"github.com/siuyin/aigotut/client"
 	"github.com/siuyin/aigotut/gfmt"
 	"github.com/siuyin/dflt"
 	"github.com/siuyin/randw"
-	"google.golang.org/api/iterator"
 	"googlemaps.github.io/maps"
 )
 
 var (
-	cl *client.Info // LLM client
+	llm gen.Backend // LLM backend, provides request-scoped generators
 
-	emCl       *client.Info // embedding client
-	em         *genai.EmbeddingModel
+	emb        embedder.Embedder // embedding backend
 	collection *chromem.Collection
 	db         *chromem.DB
 
@@ -57,12 +60,12 @@ type tmplDat struct {
 	JS   string
 }
 
-func init() {
-	client.ModelName = "gemini-1.5-flash-latest"
-	cl = client.New()
-	// safety settings doc: https://cloud.google.com/vertex-ai/generative-ai/docs/multimodal/configure-safety-attributes#gemini-TASK-samples-go
-	// HarmBlockNone is available only on "invoiced accounts".
-	cl.Model.SafetySettings = []*genai.SafetySetting{
+// safetySettings and temperature are applied to every generator
+// of the Gemini backend.
+// safety settings doc: https://cloud.google.com/vertex-ai/generative-ai/docs/multimodal/configure-safety-attributes#gemini-TASK-samples-go
+// HarmBlockNone is available only on "invoiced accounts".
+var (
+	safetySettings = []*genai.SafetySetting{
 		{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockOnlyHigh}, // need to set to High to avoid Daisy Bell trigger
 		{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockOnlyHigh}, // default is low as Daisy Bell triggers this
 		{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockOnlyHigh},
@@ -75,18 +78,31 @@ func init() {
 		// {Category: genai.HarmCategoryUnspecified, Threshold: genai.HarmBlockOnlyHigh}, // 400 response
 		// {Category: genai.HarmCategoryMedical, Threshold: genai.HarmBlockOnlyHigh}, // 400 response
 	}
-	temp := float32(0.0)
-	cl.Model.GenerationConfig.Temperature = &temp
-	em = initEmbeddingClient()
+	temperature = float32(0.0)
+)
+
+func init() {
+	llm = initLLM()
+	prompts = initPrompts()
+	loadExperiments()
+	responses = initResponseLog()
+	usageLog = initUsageLog()
+	respCache = initResponseCache()
+	emb = initEmbedder()
 	collection = initDB()
+	logDB = initLogDB()
+	kb = newKnowledgeBase(collection)
+	loadRetrievalConfigs()
+	loadRateLimits()
 	mapsClient = initMapsClient()
-	initAigogoDataPath()
+	requestTimeout = initRequestTimeout()
+	logs = initLogStore()
 
 	log.Println("application initialised")
 }
 
 func main() {
-	defer cl.Close()
+	defer llm.Close()
 
 	depl := dflt.EnvString("DEPLOY", "DEV")
 	if depl == "DEV" {
@@ -103,46 +119,164 @@ func main() {
 
 	http.HandleFunc("/memories", memoriesFunc)
 
-	http.HandleFunc("/memgen", memGenFunc)
+	http.HandleFunc("/memgen", rateLimited("generation", withDeadline(memGenFunc)))
 
 	http.HandleFunc("/ref", personalLogDetails)
+	http.HandleFunc("GET /logs", requireLogToken(logListFunc))
+	http.HandleFunc("GET /export", requireLogToken(rateLimited("export", logExportFunc)))
 
-	http.HandleFunc("/retr", retrievalFunc)
+	http.HandleFunc("/retr", rateLimited("generation", withDeadline(retrievalFunc)))
 
-	http.HandleFunc("/loc", locationFunc)
+	http.HandleFunc("/loc", rateLimited("geocoding", withDeadline(locationFunc)))
 
-	http.HandleFunc("/data", dataWrite)
+	http.HandleFunc("/data", rateLimitedBy(dataClass, withDeadline(dataWrite)))
 
 	http.HandleFunc("/getHighlightSelections", loadSelFunc)
 
 	http.HandleFunc("/userIDExist", userIDExistFunc)
 
-	http.HandleFunc("/life", life)
+	http.HandleFunc("/life", rateLimited("generation", withDeadline(life)))
+
+	http.HandleFunc("GET /doc/{id}", docFunc)
+
+	http.HandleFunc("POST /feedback", feedbackFunc)
+	http.HandleFunc("GET /experiments/export", requireAdminToken(experimentExportFunc))
+	http.HandleFunc("GET /admin/usage", requireAdminToken(usageReportFunc))
+
+	http.HandleFunc("GET /conversations", requireLogToken(conversationListFunc))
+	http.HandleFunc("DELETE /conversations", requireLogToken(conversationClearFunc))
+	http.HandleFunc("GET /conversations/{id}", requireLogToken(conversationGetFunc))
+	http.HandleFunc("DELETE /conversations/{id}", requireLogToken(conversationDeleteFunc))
+
+	http.HandleFunc("GET /kb", requireKBToken(kbListFunc))
+	http.HandleFunc("POST /kb", requireKBToken(kbCreateFunc))
+	http.HandleFunc("GET /kb/{id}", requireKBToken(kbGetFunc))
+	http.HandleFunc("PUT /kb/{id}", requireKBToken(kbUpdateFunc))
+	http.HandleFunc("DELETE /kb/{id}", requireKBToken(kbDeleteFunc))
 
 	log.Println("starting web server")
 	log.Fatal(http.ListenAndServe(":"+dflt.EnvString("HTTP_PORT", "8080"), nil))
 }
 
-func initEmbeddingClient() *genai.EmbeddingModel {
-	client.ModelName = "text-embedding-004"
-	emCl = client.New()
-	em := emCl.Client.EmbeddingModel(client.ModelName)
-	return em
+// initLLM returns the backend selected by GEN_BACKEND: "gemini" or "fake".
+// The fake backend is the default when TESTING is set.
+func initLLM() gen.Backend {
+	backend := "gemini"
+	if os.Getenv("TESTING") != "" {
+		backend = "fake"
+	}
+	var backends []gen.Backend
+	switch dflt.EnvString("GEN_BACKEND", backend) {
+	case "fake":
+		log.Println("using fake LLM backend")
+		backends = append(backends, &gen.Fake{})
+	case "gemini":
+		models := strings.Split(dflt.EnvString("GEN_MODELS", "gemini-1.5-flash-latest"), ",")
+		client.ModelName = models[0]
+		cl := client.New()
+		for _, m := range models {
+			backends = append(backends, &gen.Gemini{Client: cl.Client, ModelName: strings.TrimSpace(m),
+				SafetySettings: safetySettings, Temperature: temperature})
+		}
+		log.Printf("using Gemini models: %v", models)
+	default:
+		log.Fatalf("unknown GEN_BACKEND: %s", os.Getenv("GEN_BACKEND"))
+	}
+	p := genPolicy()
+	log.Printf("LLM call policy: %+v", p)
+	return gen.NewResilient(p, backends...)
+}
+
+// genPolicy reads the timeout, retry and circuit breaker settings for LLM calls:
+// GEN_TIMEOUT (default 60s), GEN_RETRIES (2), GEN_BACKOFF (500ms),
+// GEN_BREAKER_FAILURES (5, 0 disables the breaker) and GEN_BREAKER_COOLDOWN (30s).
+func genPolicy() gen.Policy {
+	dur := func(name, def string) time.Duration {
+		d, err := time.ParseDuration(dflt.EnvString(name, def))
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		return d
+	}
+	num := func(name, def string) int {
+		n, err := strconv.Atoi(dflt.EnvString(name, def))
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		return n
+	}
+	return gen.Policy{
+		Timeout:         dur("GEN_TIMEOUT", "60s"),
+		Retries:         num("GEN_RETRIES", "2"),
+		Backoff:         dur("GEN_BACKOFF", "500ms"),
+		BreakerFailures: num("GEN_BREAKER_FAILURES", "5"),
+		BreakerCooldown: dur("GEN_BREAKER_COOLDOWN", "30s"),
+	}
+}
+
+// initEmbedder returns the embedder selected by EMBEDDER: "gemini" or "local".
+// The local embedder is the default when TESTING is set.
+func initEmbedder() embedder.Embedder {
+	backend := "gemini"
+	if os.Getenv("TESTING") != "" {
+		backend = "local"
+	}
+	e, err := embedder.FromEnv(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("using embedder: %s", e.Name())
+	return e
 }
 
+// initDB opens the vector database.
+// With VECDB_PATH set, the database is persisted in that folder and updated in place.
+// embeddings.gob is then imported only into an empty collection, or the gob file named by
+// VECDB_IMPORT is imported over the existing documents.
+// Without VECDB_PATH, an in-memory database is built from embeddings.gob at every start.
 func initDB() *chromem.Collection {
-	docs := loadDocuments()
+	path := os.Getenv("VECDB_PATH")
+	if path == "" {
+		db = chromem.NewDB()
+	} else {
+		var err error
+		db, err = chromem.NewPersistentDB(path, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	db = chromem.NewDB()
-	c, err := db.CreateCollection("aigogo", nil, nil)
+	c, err := db.GetOrCreateCollection(collectionName(), nil, emb.Embed)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var docs []chromem.Document
+	switch imp := os.Getenv("VECDB_IMPORT"); {
+	case imp != "":
+		docs = loadDocumentsFile(imp)
+	case c.Count() == 0:
+		docs = loadDocuments()
+	default:
+		log.Printf("opened vector database %s: %d documents", path, c.Count())
+		return c
+	}
+
 	ctx := context.Background()
-	c.AddDocuments(ctx, docs, runtime.NumCPU())
+	if err := c.AddDocuments(ctx, docs, runtime.NumCPU()); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("imported %d documents, vector database has %d documents", len(docs), c.Count())
 	return c
+}
 
+// collectionName is specific to the embedder as vectors from different embedders
+// cannot be mixed in a persistent database.
+func collectionName() string {
+	if emb.Name() == embedder.GeminiModelName {
+		return "aigogo"
+	}
+	return "aigogo-" + emb.Name()
 }
 
 func initMapsClient() *maps.Client {
@@ -153,11 +287,49 @@ func initMapsClient() *maps.Client {
 	return cl
 }
 
-func initAigogoDataPath() {
-	if err := os.MkdirAll(dataPath, 0750); err != nil {
-		log.Fatal("ERROR: could not make aigogo data folder:", err)
-		return
+// requestTimeout bounds the model, embedding and Maps calls made for a request.
+var requestTimeout time.Duration
+
+// initRequestTimeout reads REQUEST_TIMEOUT, default 2m.
+func initRequestTimeout() time.Duration {
+	d, err := time.ParseDuration(dflt.EnvString("REQUEST_TIMEOUT", "2m"))
+	if err != nil {
+		log.Fatalf("REQUEST_TIMEOUT: %v", err)
 	}
+	return d
+}
+
+// withDeadline gives the request context of h a deadline of requestTimeout.
+// The context is also cancelled when the client goes away.
+func withDeadline(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestTimeout <= 0 {
+			h(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// logs stores the users' personal logs.
+var logs *logstore.Store
+
+// initLogStore returns the store selected by LOG_STORE: "fs" (files under
+// LOG_DIR, default /data/aigogo), "sqlite" (the database LOG_DB, default
+// /data/aigogo/logs.db) or "memory". The memory store is the default when TESTING is set.
+func initLogStore() *logstore.Store {
+	kind := "fs"
+	if os.Getenv("TESTING") != "" {
+		kind = "memory"
+	}
+	b, err := logstore.Open(dflt.EnvString("LOG_STORE", kind), dflt.EnvString("LOG_DIR", dataPath), dflt.EnvString("LOG_DB", dataPath+"/logs.db"))
+	if err != nil {
+		log.Fatalf("could not open log store: %v", err)
+	}
+	log.Printf("using log store: %T", b)
+	return logstore.New(b)
 }
 
 // ------------------------------------------------
@@ -181,23 +353,39 @@ func memoriesFunc(w http.ResponseWriter, _ *http.Request) {
 }
 
 func memGenFunc(w http.ResponseWriter, r *http.Request) {
-	logEntr := randSelection(personalLogEntries(r.FormValue("userID")), 5)
-	generateMemories(logEntr, w, r)
+	generateMemories(memoryEntries(r), w, r)
 }
 
 func retrievalFunc(w http.ResponseWriter, r *http.Request) {
-	qry := r.FormValue("userPrompt")
-	doc := retrieveDocsForAugmentation(r, qry)
-	if len(doc) == 0 {
-		io.WriteString(w, "No relevant documents found")
+	conv, ok := conversationFor(w, r)
+	if !ok {
 		return
 	}
-	//writeRetrievedDocs(w, doc)
-	if os.Getenv("TESTING") != "" {
-		fmt.Fprintf(w, "calling augmentGenerationWithDoc: %v", doc)
-		return
+	qry := r.FormValue("userPrompt")
+	res := retrieveDocsForAugmentation(r, retrievalQuery(conv, qry))
+	if len(res) == 0 {
+		log.Printf("no relevant documents found for: %s", qry)
+	}
+	setSourcesHeader(w, sources(res))
+	if conv != nil {
+		w.Header().Set("X-Conversation", conv.ID)
+	}
+	s := newStream(w, r, "<p>I've encounted an issue: %v:")
+	if conv != nil {
+		s.conversation(conv.ID)
+	}
+	s.sources(sources(res))
+	if r.FormValue("debug") != "" {
+		s.debug(res)
 	}
-	augmentGenerationWithDoc(w, r, doc)
+	doc := []string{}
+	ids := []string{}
+	for _, d := range res {
+		doc = append(doc, d.Content)
+		ids = append(ids, d.ID)
+	}
+	//writeRetrievedDocs(w, doc)
+	augmentGenerationWithDoc(s, r, doc, ids, conv)
 }
 
 func locationFunc(w http.ResponseWriter, r *http.Request) {
@@ -210,16 +398,56 @@ func locationFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res := getLocationAPIResp(r)
+	res, err := getLocationAPIResp(r)
+	if err != nil {
+		log.Printf("WARNING: geocoding failure: %v", err)
+		io.WriteString(w, "location unavailable")
+		return
+	}
 
 	var mapRes *mapResponse
 	mapRes = decodeLocationAPIResp(res, mapRes)
 	fmt.Fprintf(w, "%s", mapRes.Results[0].FormattedAddress)
 }
 
-func augmentGenerationWithDoc(w http.ResponseWriter, r *http.Request, doc []string) {
-	defineSystemInstructionWithDocs(doc, r)
-	streamResponseFromUserPrompt(r.FormValue("userPrompt"), w)
+// augmentGenerationWithDoc streams a reply based on doc, continuing conv if it is not nil.
+// Replies outside conversations are cached by prompt and document IDs.
+func augmentGenerationWithDoc(s *stream, r *http.Request, doc, ids []string, conv *conversation) {
+	g := llm.NewGenerator()
+	promptID, keyText, err := defineSystemInstructionWithDocs(g, doc, r)
+	if err != nil {
+		s.error(err.Error())
+		return
+	}
+	defer func() {
+		recordResponse(r, s, promptID, r.FormValue("userPrompt"))
+		recordStreamUsage(r, r.URL.Path, g.Model(), s)
+	}()
+	if conv == nil || len(conv.History) == 0 {
+		// a first turn has no history, so it is answered, and cached, like a one-shot request
+		userPrompt := r.FormValue("userPrompt")
+		streamResponseFromUserPrompt(r.Context(), g, userPrompt, s, gen.Key(append([]string{promptID, keyText, userPrompt}, ids...)...))
+		if conv == nil {
+			return
+		}
+		if s.failed || s.cancelled || s.out.Len() == 0 {
+			log.Printf("conversation %s: reply incomplete, turn not saved", conv.ID)
+			return
+		}
+		conversations.addTurn(*conv,
+			&genai.Content{Role: "user", Parts: []genai.Part{genai.Text(userPrompt)}},
+			&genai.Content{Role: "model", Parts: []genai.Part{genai.Text(s.out.String())}})
+		return
+	}
+
+	chat := g.StartChat(conv.History)
+	s.copy(chat.SendMessageStream(r.Context(), genai.Text(r.FormValue("userPrompt"))))
+	h := chat.History()
+	if len(h) == 0 || h[len(h)-1].Role != "model" {
+		log.Printf("conversation %s: reply incomplete, turn not saved", conv.ID)
+		return
+	}
+	conversations.addTurn(*conv, h[len(conv.History):]...)
 }
 
 func dataWrite(w http.ResponseWriter, r *http.Request) {
@@ -244,7 +472,15 @@ func dataWrite(w http.ResponseWriter, r *http.Request) {
 
 func life(w http.ResponseWriter, r *http.Request) {
 	latlng := r.FormValue("latlng")
-	meaningOfLife(w, r.FormValue("loc"), time.Now().In(tzLoc(latlng)).Format("Monday, 15:04PM, 2 January 2006"))
+	s := newStream(w, r, "<p>hmm.. apparently I have an issue:%v")
+	g := llm.NewGenerator()
+	promptID, err := meaningOfLife(r.Context(), g, s, r.FormValue("userID"), r.FormValue("loc"), time.Now().In(tzLoc(r.Context(), latlng)))
+	if err != nil {
+		s.error(err.Error())
+		return
+	}
+	recordResponse(r, s, promptID, "")
+	recordStreamUsage(r, r.URL.Path, g.Model(), s)
 }
 
 func loadSelFunc(w http.ResponseWriter, r *http.Request) {
@@ -253,7 +489,7 @@ func loadSelFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s := loadCustomHighlights(r.FormValue("userID"))
+	s := loadCustomHighlights(r.Context(), r.FormValue("userID"))
 	if os.Getenv("TESTING") != "" {
 		fmt.Fprintf(w, "custom highlights loaded: %v", s)
 		return
@@ -274,118 +510,55 @@ func userIDExistFunc(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "Kit Siew")
 }
 
-func streamResponseFromUserPrompt(userPrompt string, w http.ResponseWriter) {
+// streamResponseFromUserPrompt streams the response cached under key, if any.
+func streamResponseFromUserPrompt(ctx context.Context, g gen.Generator, userPrompt string, s *stream, key string) {
 	log.Println("calling generate content stream with: ", userPrompt)
-	iter := cl.Model.GenerateContentStream(context.Background(),
-		genai.Text(userPrompt))
-	for {
-		resp, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			fmt.Fprintf(w, "<p>I've encounted an issue: %v:", err)
-			resp = iter.MergedResponse()
-			if resp == nil {
-				return
-			}
-			log.Printf("num cand: %v, finishReason: %v", len(resp.Candidates), resp.Candidates[0].FinishReason)
-			for _, c := range resp.Candidates {
-				for _, sr := range c.SafetyRatings {
-					fmt.Fprintf(w, " category:%v, probability: %v, blocked: %v", sr.Category, sr.Probability, sr.Blocked)
-				}
-			}
-			return
-		}
-		fPrintResponse(w, resp)
-	}
+	iter, hit := cachedStream(key, userPrompt, func() gen.Iterator {
+		return g.GenerateContentStream(ctx, genai.Text(userPrompt))
+	})
+	s.cached = hit
+	s.copy(iter)
 }
 
-func defineSystemInstructionWithDocs(doc []string, r *http.Request) {
+// defineSystemInstructionWithDocs returns the ID of the prompt template used and
+// the system instruction with the time to the hour, for use in cache keys.
+func defineSystemInstructionWithDocs(g gen.Generator, doc []string, r *http.Request) (string, string, error) {
 	location := r.FormValue("loc")
 	latlng := r.FormValue("latlng")
 	weatherJSON := r.FormValue("weather")
-	currentTime := time.Now().In(tzLoc(latlng)).Format("Monday, 15:04PM, 2 January 2006")
+	tz := tzLoc(r.Context(), latlng)
+	now := time.Now().In(tz)
+	currentTime := now.Format(timeLayout)
 
-	rwords := fmt.Sprintf("%v", randw.Select(5))
-	if !strings.Contains(strings.ToLower(r.FormValue("userPrompt")), "random") {
-		rwords = ""
+	var rwords []string
+	if strings.Contains(strings.ToLower(r.FormValue("userPrompt")), "random") {
+		rwords = randw.Select(5)
 	}
 	log.Printf("random words: %v", rwords)
 
-	cl.Model.SystemInstruction = &genai.Content{
-		Parts: []genai.Part{genai.Text(fmt.Sprintf(`You are a considerate and kind
-		caregiver for an aged person. If asked your name is AiGoGo.
-		You  aim to entertain and engage with the
-		person to maintain her mental acuity and to stave off dementia.
-		Your responses are kind but authoritative and firm. Below are RESOURCE 1 and
-		RESOURCE 2 from experienced caregiver KitSiew. 
-		
-		RESOURCE 1: %v
-
-		RESOURCE 2: %v
-
-		Prioritize including suggestions from the above resources if and only if they
-		are relevent. Where there
-		are multiple equally feasible options, pick one at random. If you feel
-		one is particularly relevant explain why the reasoning behind your choice.
-
-		If a RESOURCE has safety relevant warnings like "it is not well lit" you must
-		adhere to this infomation and do not express your own opinion. Stick to the facts.
-
-		If a RESOURCE is not relevant to the user's question, you may ignore its contents.
-
-		If the user's prompt includes the word "Randomize" or "random" you must use the words
-		in the RANDOM WORDS section below in your output. 
-
-		RANDOM WORDS: %v
-
-		If there is insufficent data, please supplement your response with what you know.
-		Some of the user prompts or queries will relate to singing songs. In this case,
-		look up what you know about the relevant song title's lyrics and include some
-		portion of the lyrics into your response.
-
-		DO NOT quote RESOURCE 1, RESOURCE 2 or RANDOM WORDS -- they are for your internal use and
-		reference.
-
-		When formulating your response consider the current date and time: %s,
-		timezone: %s,and also the user's location: %s.
-		
-		This is particulary important when your response includes an outdoor activity
-		as the elderly may trip and fall in the dark.
-		You may mention the time and timezone in your response.
-
-		Evaluate the following weather forecast JSON:
-		%s
-
-		If the user is contemplating an outdoor activity you must provide 
-		a summary of your interpretation of the weather forecast that
-		includes actual temperature range, perceived temperature range and chance of
-		percipitation as a percentage.
-
-		If you are quoting a time or a day part, eg. morning, afternoon, evening,
-		be sure to mention the time together with the
-		long form timezone (eg. Singapore Time or Mountain Standard Time).
-
-		Try to weave in a relevant Aesop fable and look up Kit Siew's life lessons
-		on https://beyondbroadcast.com/ . Choose a fable that is connected to a word
-		in RANDOM WORDS.
-		
-		Make at least two recommendations, the main recommendation and the alternative.
-		Make it clear that the user has a choice.`,
-			doc[0], doc[1], rwords, currentTime, tzLoc(latlng).String(), location, weatherJSON))},
+	sys, id, err := renderPrompt("caregiver", r.FormValue("userID"), prompt.Vars{
+		Resources:   doc,
+		RandomWords: rwords,
+		Time:        currentTime,
+		Timezone:    tz.String(),
+		Location:    location,
+		Weather:     weatherJSON,
+	})
+	if err != nil {
+		return "", "", err
 	}
-
+	g.SetSystemInstruction(sys)
+	return id, hourly(sys, now), nil
 }
 
-func getLocationAPIResp(r *http.Request) *http.Response {
+func getLocationAPIResp(r *http.Request) (*http.Response, error) {
 	key := dflt.EnvString("MAPS_API_KEY", "use your real api key")
 	latlng := r.FormValue("latlng")
-	res, err := http.Get(fmt.Sprintf("https://maps.googleapis.com/maps/api/geocode/json?latlng=%s&result_type=street_address&key=%s", latlng, key))
+	req, err := http.NewRequestWithContext(r.Context(), "GET", fmt.Sprintf("https://maps.googleapis.com/maps/api/geocode/json?latlng=%s&result_type=street_address&key=%s", latlng, key), nil)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	return res
+	return http.DefaultClient.Do(req)
 }
 func decodeLocationAPIResp(res *http.Response, mapRes *mapResponse) *mapResponse {
 	dec := json.NewDecoder(res.Body)
@@ -424,10 +597,24 @@ func loadDocuments() []chromem.Document {
 	}
 	defer f.Close()
 
-	var rec rag.Doc
+	return decodeDocuments(f)
+}
+
+func loadDocumentsFile(fn string) []chromem.Document {
+	f, err := os.Open(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	return decodeDocuments(f)
+}
+
+func decodeDocuments(f io.Reader) []chromem.Document {
 	dec := gob.NewDecoder(f)
 	docs := []chromem.Document{}
 	for {
+		var rec rag.Doc // fresh value as gob merges decoded maps into existing ones
 		if err := dec.Decode(&rec); err != nil {
 			break
 		}
@@ -437,91 +624,88 @@ func loadDocuments() []chromem.Document {
 }
 
 func addDoc(docs []chromem.Document, rec *rag.Doc) []chromem.Document {
-	d := chromem.Document{
-		ID:       rec.ID,
-		Content:  rec.Title + " | " + rec.Content,
-		Metadata: map[string]string{"context": rec.Context},
-	}
+	d := chromemDoc(*rec)
 	if os.Getenv("DEBUG") != "" {
 		log.Println("adding: ", rec.Title, rec.Context)
 	}
+	model := rec.EmbeddingModel
+	if model == "" {
+		model = embedder.GeminiModelName
+	}
+	if model != emb.Name() { // leave empty for the collection to embed with emb
+		docs = append(docs, d)
+		return docs
+	}
 	d.Embedding = append(d.Embedding, rec.Embedding...)
 	docs = append(docs, d)
 	return docs
 }
 
-func meaningOfLife(w http.ResponseWriter, location string, currentTime string) {
-	cl.Model.SystemInstruction = &genai.Content{
-		Parts: []genai.Part{genai.Text(fmt.Sprintf(`You are a philosophy professor
-		who likes to quote Shakespear and answers questions with questions.
-		Your response should be at least 100 words long.
-		Weave into your response the user's location: %s
-		and the current time %s.
-		`, location, currentTime))},
-	}
-	iter := cl.Model.GenerateContentStream(context.Background(),
-		genai.Text("What is the meaning of life?"))
-	for {
-		resp, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			io.WriteString(w, "<p>hmm.. apparently I have an issue:"+err.Error())
-			return
-		}
-
-		fPrintResponse(w, resp)
-	}
+// meaningOfLife returns the ID of the prompt template used.
+func meaningOfLife(ctx context.Context, g gen.Generator, s *stream, userID, location string, now time.Time) (string, error) {
+	sys, id, err := renderPrompt("philosopher", userID, prompt.Vars{Location: location, Time: now.Format(timeLayout)})
+	if err != nil {
+		return "", err
+	}
+	g.SetSystemInstruction(sys)
+	const question = "What is the meaning of life?"
+	iter, hit := cachedStream(gen.Key(id, hourly(sys, now), question), question, func() gen.Iterator {
+		return g.GenerateContentStream(ctx, genai.Text(question))
+	})
+	s.cached = hit
+	s.copy(iter)
+	return id, nil
 }
 
-func fPrintResponse(w http.ResponseWriter, resp *genai.GenerateContentResponse) {
-	f, _ := w.(http.Flusher)
-	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				w.Write([]byte(part.(genai.Text)))
-				f.Flush()
-			}
-		}
+// retrieveDocsForAugmentation combines vector and keyword search over the
+// documents of the request's context with reciprocal rank fusion.
+// If the query cannot be embedded, only keyword search is used.
+func retrieveDocsForAugmentation(r *http.Request, qry string) []retrieved {
+	cfg := retrievalConfigFor(r)
+	usrCtx := r.FormValue("ctx")
+	// chromem requires nResults to be no more than the number of matching documents
+	numResults := min(candidates(cfg.K), kb.count(usrCtx), collection.Count())
+	if cfg.K == 0 || numResults == 0 {
+		return nil
 	}
-}
 
-func retrieveDocsForAugmentation(r *http.Request, qry string) []string {
-	if os.Getenv("TESTING") != "" {
-		return []string{"testDoc1", "testDoc2"}
-	}
-	ctx := context.Background()
-	res, err := em.EmbedContent(ctx, genai.Text(qry))
-	if err != nil {
-		log.Fatal(err)
+	ctx := r.Context()
+	var qres []chromem.Result
+	qv, err := emb.Embed(ctx, qry)
+	if err == nil {
+		qres, err = collection.QueryEmbedding(ctx, qv, numResults, map[string]string{"context": usrCtx}, nil)
 	}
-
-	numResults := 2
-	usrCtx := r.FormValue("ctx")
-	qres, err := collection.QueryEmbedding(ctx, res.Embedding.Values, numResults, map[string]string{"context": usrCtx}, nil)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("WARNING: vector search failed, using keyword search only: %v", err)
 	}
 
-	doc := []string{}
+	vec := []chromem.Result{}
 	for i := 0; i < len(qres); i++ {
 		if os.Getenv("DEBUG") != "" {
-			fmt.Println("vector DB:", qres[i].ID, qres[i].Content)
+			fmt.Println("vector DB:", qres[i].ID, qres[i].Similarity, qres[i].Content)
+		}
+		if cfg.MinSimilarity > 0 && qres[i].Similarity < cfg.MinSimilarity {
+			continue
 		}
-		doc = append(doc, qres[i].Content)
+		vec = append(vec, qres[i])
 	}
-	return doc
+
+	ids := kb.ids(usrCtx)
+	kw := kb.keywords.Search(qry, numResults, func(id string) bool { return ids[id] })
+	return fuse(vec, kw, cfg)
 }
 
-func localTimezoneName(latlng *maps.LatLng) (string, string) {
+func localTimezoneName(ctx context.Context, latlng *maps.LatLng) (string, string, error) {
+	if os.Getenv("TESTING") != "" {
+		return "UTC", "Coordinated Universal Time", nil
+	}
 	r := &maps.TimezoneRequest{Timestamp: time.Now(), Location: latlng}
 
-	resp, err := mapsClient.Timezone(context.Background(), r)
+	resp, err := mapsClient.Timezone(ctx, r)
 	if err != nil {
-		log.Fatalf("Timezone: %v", err)
+		return "", "", err
 	}
-	return resp.TimeZoneID, resp.TimeZoneName
+	return resp.TimeZoneID, resp.TimeZoneName, nil
 }
 
 func latLng(latlng string) *maps.LatLng {
@@ -538,12 +722,47 @@ func latLng(latlng string) *maps.LatLng {
 	return &maps.LatLng{Lat: lat, Lng: lng}
 }
 
-func tzLoc(latlng string) *time.Location {
-	zoneName, _ := localTimezoneName(latLng(latlng))
-	loc, err := time.LoadLocation(zoneName)
+// zoneCache holds the time zones found, by latlng rounded to about a
+// kilometre, so that each request need not call the Maps Timezone API.
+type zoneCache struct {
+	mu sync.Mutex
+	m  map[string]*time.Location
+}
+
+// maxZones bounds the locations in zoneCache. It is emptied when full.
+const maxZones = 10000
+
+var zones = &zoneCache{m: map[string]*time.Location{}}
+
+// timezoneLookup finds the time zone at a location. Tests replace it.
+var timezoneLookup = localTimezoneName
+
+// tzLoc returns the time zone at latlng, or UTC if it cannot be found.
+func tzLoc(ctx context.Context, latlng string) *time.Location {
+	ll := latLng(latlng)
+	key := fmt.Sprintf("%.2f,%.2f", ll.Lat, ll.Lng)
+	zones.mu.Lock()
+	loc, ok := zones.m[key]
+	zones.mu.Unlock()
+	if ok {
+		return loc
+	}
+
+	zoneName, _, err := timezoneLookup(ctx, ll)
+	if err != nil {
+		log.Printf("WARNING: timezone lookup failure, using UTC: %v", err)
+		return time.UTC
+	}
+	loc, err = time.LoadLocation(zoneName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	zones.mu.Lock()
+	defer zones.mu.Unlock()
+	if len(zones.m) >= maxZones {
+		zones.m = map[string]*time.Location{}
+	}
+	zones.m[key] = loc
 	return loc
 }
 
@@ -560,36 +779,32 @@ func saveAudioLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	aud := saveAudioFile(w, r)
-	transcribeAudio(aud, w)
+	transcribeAudio(r, aud, w)
 }
 
-func transcribeAudio(dat []byte, w http.ResponseWriter) {
-	customNames := loadCustomNames()
-	cl.Model.SystemInstruction = &genai.Content{
-		Parts: []genai.Part{genai.Text("")}}
-	prompt := fmt.Sprintf(`Please transcribe the following audio.
-	If you come across terms that you are unfamiliar with look up the following table to see one of the entries matches:
-	%s`, customNames)
-	resp, err := cl.Model.GenerateContent(context.Background(), genai.Blob{MIMEType: "audio/ogg", Data: dat}, genai.Text(prompt))
+func transcribeAudio(r *http.Request, dat []byte, w http.ResponseWriter) {
+	customNames := loadCustomNames(r.Context(), r.FormValue("userID"))
+	p, _, err := renderPrompt("transcribe", "", prompt.Vars{Names: customNames})
 	if err != nil {
 		log.Printf("WARNING: transcription failure: %v", err)
 		return
 	}
-	gfmt.FprintResponse(w, resp)
-}
-
-func loadCustomNames() string {
-	f, err := os.Open(dataPath + "/123456/names.txt")
+	g := llm.NewGenerator()
+	resp, err := g.GenerateContent(r.Context(), genai.Blob{MIMEType: "audio/ogg", Data: dat}, genai.Text(p))
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("WARNING: transcription failure: %v", err)
+		return
 	}
-	defer f.Close()
+	recordUsage(r, "/data transcribe", g.Model(), resp.UsageMetadata)
+	gfmt.FprintResponse(w, resp)
+}
 
-	b, err := io.ReadAll(f)
+func loadCustomNames(ctx context.Context, userID string) string {
+	names, err := logs.Names(ctx, userID)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("WARNING: could not load custom names: %v", err)
 	}
-	return string(b)
+	return names
 }
 
 func saveAudioFile(w http.ResponseWriter, r *http.Request) []byte {
@@ -602,7 +817,7 @@ func saveAudioFile(w http.ResponseWriter, r *http.Request) []byte {
 	af := logFile{
 		userID:   r.FormValue("userID"),
 		basename: r.FormValue("filename"),
-		ext:      "ogg",
+		kind:     logstore.Audio,
 		body:     dat,
 	}
 	createFile(af)
@@ -613,19 +828,15 @@ func saveAudioFile(w http.ResponseWriter, r *http.Request) []byte {
 type logFile struct {
 	userID   string
 	basename string
-	ext      string
+	kind     logstore.Kind
 	body     []byte
 }
 
+// createFile stores lf. It is stored even if the client has gone away.
 func createFile(lf logFile) {
-	f, err := os.Create(dataPath + "/" + lf.userID + "/" + lf.basename + "." + lf.ext)
-	if err != nil {
-		log.Fatalf("ERROR: could not create %s.%s: %v", lf.basename, lf.ext, err)
-		return
+	if err := logs.Put(context.Background(), lf.userID, lf.basename, lf.kind, lf.body); err != nil {
+		log.Printf("ERROR: could not create %s.%s: %v", lf.basename, lf.kind, err)
 	}
-	defer f.Close()
-
-	f.Write(lf.body)
 }
 
 func saveEditedLogAndSummary(w http.ResponseWriter, r *http.Request) {
@@ -634,25 +845,33 @@ func saveEditedLogAndSummary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	editedLog := saveEditedLog(w, r)
-	summary := summarize(editedLog, w)
+	summary := summarize(r, editedLog, w)
+	if len(summary) == 0 {
+		return // summarization failed, the entry is summarized when next saved
+	}
 	sm := logFile{
 		userID:   r.FormValue("userID"),
 		basename: r.FormValue("editedlog"),
-		ext:      "summary.txt",
+		kind:     logstore.Summary,
 		body:     summary,
 	}
 	createFile(sm)
+	indexLogEntry(sm.userID, sm.basename)
 }
 
-func summarize(dat []byte, w http.ResponseWriter) []byte {
-	prompt := fmt.Sprintf(`Please summarize the following text in the first person.
-	Keep the metadata (lines following the ---) intact:
-	%s`, dat)
-	resp, err := cl.Model.GenerateContent(context.Background(), genai.Text(prompt))
+func summarize(r *http.Request, dat []byte, w http.ResponseWriter) []byte {
+	p, _, err := renderPrompt("summarize", "", prompt.Vars{Text: string(dat)})
 	if err != nil {
 		log.Printf("WARNING: summarization failure: %v", err)
 		return []byte{}
 	}
+	g := llm.NewGenerator()
+	resp, err := g.GenerateContent(r.Context(), genai.Text(p))
+	if err != nil {
+		log.Printf("WARNING: summarization failure: %v", err)
+		return []byte{}
+	}
+	recordUsage(r, "/data summarize", g.Model(), resp.UsageMetadata)
 	gfmt.FprintResponse(w, resp)
 
 	var b bytes.Buffer
@@ -662,27 +881,51 @@ func summarize(dat []byte, w http.ResponseWriter) []byte {
 }
 
 func saveEditedLog(w http.ResponseWriter, r *http.Request) []byte {
-	metadata := fmt.Sprintf("\n---\nlatlng:%s, neighborhood:%s, primaryHighlight:%s, secondaryHighlight:%s, people:%s",
-		r.FormValue("latlng"), r.FormValue("neighborhood"), r.FormValue("primary"), r.FormValue("secondary"),
-		r.FormValue("people"))
-
 	dat, err := io.ReadAll(r.Body)
 	if err != nil {
 		fmt.Fprintf(w, "could not read request body: %v", err)
 		return []byte{}
 	}
-	dat = []byte(string(dat) + metadata)
 
 	editedLog := logFile{
 		userID:   r.FormValue("userID"),
 		basename: r.FormValue("editedlog"),
-		ext:      "txt",
+		kind:     logstore.Transcript,
 		body:     dat,
 	}
 	createFile(editedLog)
+	saveLogMeta(r)
 	return dat
 }
 
+// saveLogMeta stores the metadata of the edited log entry from the request's form values.
+func saveLogMeta(r *http.Request) {
+	userID, bn := r.FormValue("userID"), r.FormValue("editedlog")
+	ctx := context.Background() // store it even if the client has gone away
+	now := time.Now().UTC()
+	m := logstore.Meta{
+		Location:           logstore.ParseLatLng(r.FormValue("latlng")),
+		Neighborhood:       r.FormValue("neighborhood"),
+		PrimaryHighlight:   r.FormValue("primary"),
+		SecondaryHighlight: r.FormValue("secondary"),
+		People:             logstore.ParsePeople(r.FormValue("people")),
+		Created:            now,
+		Updated:            now,
+		Source:             "text",
+	}
+	if old, err := logs.GetMeta(ctx, userID, bn); err == nil {
+		m.Created = old.Created
+	} else if t, ok := logstore.EntryTime(bn); ok {
+		m.Created = t
+	}
+	if names, err := logs.List(ctx, userID); err == nil && slices.Contains(names, bn+"."+string(logstore.Audio)) {
+		m.Source = "audio"
+	}
+	if err := logs.PutMeta(ctx, userID, bn, m); err != nil {
+		log.Printf("ERROR: could not save metadata of %s: %v", bn, err)
+	}
+}
+
 func processTestRequest(w http.ResponseWriter, r *http.Request) {
 	ter := r.FormValue("ter")
 	log.Printf("rececived: ter=%s", ter)
@@ -704,45 +947,31 @@ func processTestRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	sd.Time = t
 
-	if err := os.MkdirAll(dataPath+"/"+sd.ID, 0750); err != nil {
-		log.Fatalf("ERROR: could not create user folder: %v", err)
+	if err := logs.Write(r.Context(), sd.ID, "test.json", dat); err != nil {
+		log.Printf("ERROR: could not create test.json: %v", err)
 		return
 	}
 
-	f, err := os.Create(dataPath + "/" + sd.ID + "/test.json")
-	if err != nil {
-		log.Fatalf("ERROR: could not create test.json: %v", err)
-		return
-	}
-	defer f.Close()
-
-	f.Write(dat)
-
 	fmt.Fprintf(w, "data write request received: %#v", sd)
 }
 
-func loadCustomHighlights(userID string) []string {
-	f, err := os.Open(dataPath + "/" + userID + "/highlights.txt")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-
-	b, err := io.ReadAll(f)
+func loadCustomHighlights(ctx context.Context, userID string) []string {
+	h, err := logs.Highlights(ctx, userID)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("WARNING: could not load highlights of %s: %v", userID, err)
+		return []string{}
 	}
-	s := strings.Split(string(b), "\n")
-	return s[:len(s)-1]
+	return h
 }
 
-func personalLogEntries(userID string) []string {
-	d := os.DirFS(dataPath + "/" + userID)
-	m, err := fs.Glob(d, "*.summary.txt")
+// personalLogEntries returns the basenames of the user's summarized log entries.
+func personalLogEntries(ctx context.Context, userID string) []string {
+	e, err := logs.Entries(ctx, userID)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR: could not list log entries of %s: %v", userID, err)
+		return []string{}
 	}
-	return m
+	return e
 }
 
 func randSelection(list []string, n int) []string {
@@ -759,84 +988,48 @@ func randSelection(list []string, n int) []string {
 }
 
 func generateMemories(logEntr []string, w http.ResponseWriter, r *http.Request) {
+	s := newStream(w, r, "<p>hmm.. apparently I have an issue:%v")
 	if r.FormValue("userID") == "" {
-		io.WriteString(w, "Error: empty userID received")
+		s.error("Error: empty userID received")
 		return
 	}
 
-	cl.Model.SystemInstruction = &genai.Content{
-		Parts: []genai.Part{genai.Text(`You are a young personal
-		assitant to an older person. You have a bubbly and cheerful personality. 
-		If asked, your name is AiGoGo.
-		You  aim to entertain and engage with the
-		person to maintain her mental acuity and to stave off dementia.
-
-		When quoting an event, you must state the date and/or time in the form
-		"(5 Aug 2024)" or "(5 Aug 2024, 15:25UTC)".
-		Extract the day,date and time from the 
-		log entry line (eg. "log-2024-08-04T02:25:10.513Z").
-		
-		If the data provided in the user prompt is not relevant, you may
-		extrapolate and generate content. However you must explicitly state
-		that you are doing this.
-
-		At the end of your output you must quote all the log entries
-		i.e. the lines similar to "log-2024-08-04T02:25:10.513Z",
-		wrapped in html links similar to
-		<a href="/ref?log=log-2024-08-04T02:25:10.513Z" class="popup">log-2024-08-04T02:25:10.513Z</a>
-		comma seperated,
-		preceeded by "ref:[" and closed with "]". 
-
-		Limit your output to 65 words.
-		`)},
+	g := llm.NewGenerator()
+	sys, promptID, err := renderPrompt("memories", r.FormValue("userID"), prompt.Vars{})
+	if err != nil {
+		s.error(err.Error())
+		return
 	}
+	g.SetSystemInstruction(sys)
 
-	logEntries := getLogEntries(logEntr, r.FormValue("userID"))
+	logEntries := getLogEntries(r.Context(), logEntr, r.FormValue("userID"))
 	userPrompt := r.FormValue("userPrompt") + "\n" + logEntries
-	if os.Getenv("TESTING") != "" {
-		io.WriteString(w, "calling GenerateContentStream")
-		return
-	}
 
-	iter := cl.Model.GenerateContentStream(context.Background(),
+	iter := g.GenerateContentStream(r.Context(),
 		genai.Text(userPrompt))
-	for {
-		resp, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			io.WriteString(w, "<p>hmm.. apparently I have an issue:"+err.Error())
-			return
-		}
-		fPrintResponse(w, resp)
-	}
+	s.copy(iter)
+	// the entries are recorded by name, their transcripts stay in the personal log
+	recordResponse(r, s, promptID, r.FormValue("userPrompt")+"\nentries: "+strings.Join(logEntr, ", "))
+	recordStreamUsage(r, r.URL.Path, g.Model(), s)
 }
 
-func logBasename(fn string) string {
-	return strings.Split(fn, ".summary.txt")[0]
-}
-
-func getLogEntries(logEntr []string, userID string) string {
+func getLogEntries(ctx context.Context, logEntr []string, userID string) string {
 	s := ""
-	for _, e := range logEntr {
-		bn := logBasename(e)
-		body := getBody(bn+".txt", userID) // use the transcript and not the summary
+	for _, bn := range logEntr {
+		body := getBody(ctx, userID, bn, logstore.Transcript) // use the transcript and not the summary
+		if m, err := logs.GetMeta(ctx, userID, bn); err == nil {
+			body += "\n" + m.String()
+		}
 		s += bn + ":\n" + body + "\n\n"
 	}
 	return s
 }
 
-func getBody(fn string, userID string) string {
-	f, err := os.Open(dataPath + "/" + userID + "/" + fn)
+// getBody returns part k of a log entry, or "" if it cannot be read.
+func getBody(ctx context.Context, userID, basename string, k logstore.Kind) string {
+	b, err := logs.Get(ctx, userID, basename, k)
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-
-	b, err := io.ReadAll(f)
-	if err != nil {
-		log.Fatal(err)
+		log.Printf("WARNING: could not read %s.%s of %s: %v", basename, k, userID, err)
 	}
 	return string(b)
 }
@@ -859,6 +1052,7 @@ func personalLogDetails(w http.ResponseWriter, r *http.Request) {
 		Summary    string
 		Transcript string
 		Audio      []byte
+		Meta       *logstore.Meta `json:",omitempty"`
 	}
 	dt, err := time.Parse("log-2006-01-02T15:04:05.000Z", r.FormValue("log"))
 	if err != nil {
@@ -868,9 +1062,12 @@ func personalLogDetails(w http.ResponseWriter, r *http.Request) {
 	det := logDet{
 		UserID: r.FormValue("userID"), Basename: r.FormValue("log"),
 		Date:       dt.Format("Monday, 2 Jan 2006, 15:04:05 UTC"),
-		Summary:    getBody(r.FormValue("log")+".summary.txt", r.FormValue("userID")),
-		Transcript: getBody(r.FormValue("log")+".txt", r.FormValue("userID")),
-		Audio:      []byte(getBody(r.FormValue("log")+".ogg", r.FormValue("userID"))),
+		Summary:    getBody(r.Context(), r.FormValue("userID"), r.FormValue("log"), logstore.Summary),
+		Transcript: getBody(r.Context(), r.FormValue("userID"), r.FormValue("log"), logstore.Transcript),
+		Audio:      []byte(getBody(r.Context(), r.FormValue("userID"), r.FormValue("log"), logstore.Audio)),
+	}
+	if m, err := logs.GetMeta(r.Context(), r.FormValue("userID"), r.FormValue("log")); err == nil {
+		det.Meta = &m
 	}
 	b, err := json.Marshal(det)
 	if err != nil {
@@ -1,15 +1,40 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/google/generative-ai-go/genai"
+	"github.com/philippgille/chromem-go"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/bm25"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/gen"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/prompt"
+	"github.com/siuyin/aigogo/embedder"
+	"github.com/siuyin/aigogo/logstore"
+	"github.com/siuyin/aigogo/rag"
+	"github.com/siuyin/aigogo/usage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"googlemaps.github.io/maps"
 )
 
@@ -18,37 +43,110 @@ func TestTimezone(t *testing.T) {
 		t.Skip()
 		return
 	}
-	id, name := localTimezoneName(&maps.LatLng{Lat: 1.3545457, Lng: 103.7636865})
+	id, name, err := localTimezoneName(context.Background(), &maps.LatLng{Lat: 1.3545457, Lng: 103.7636865})
+	if err != nil {
+		t.Fatal(err)
+	}
 	fmt.Println(id, name)
 }
 
+func TestZoneCache(t *testing.T) {
+	old, oldZones := timezoneLookup, zones
+	t.Cleanup(func() { timezoneLookup, zones = old, oldZones })
+	zones = &zoneCache{m: map[string]*time.Location{}}
+	calls := 0
+	timezoneLookup = func(ctx context.Context, ll *maps.LatLng) (string, string, error) {
+		calls++
+		if ll.Lat < 0 {
+			return "", "", errors.New("quota exceeded")
+		}
+		return "Asia/Singapore", "Singapore Standard Time", nil
+	}
+	ctx := context.Background()
+	if loc := tzLoc(ctx, "1.3541,103.7632"); loc.String() != "Asia/Singapore" || calls != 1 {
+		t.Errorf("got %v after %d calls", loc, calls)
+	}
+	if loc := tzLoc(ctx, "1.3549,103.7628"); loc.String() != "Asia/Singapore" || calls != 1 {
+		t.Errorf("a nearby location should use the cached zone: %v after %d calls", loc, calls)
+	}
+	tzLoc(ctx, "1.30,103.85")
+	if calls != 2 {
+		t.Errorf("another location should be looked up: %d calls", calls)
+	}
+	for i := 0; i < 2; i++ {
+		if loc := tzLoc(ctx, "-33.87,151.21"); loc != time.UTC {
+			t.Errorf("failed lookup should give UTC: %v", loc)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("failed lookups should not be cached: %d calls", calls)
+	}
+}
+
+// TestMain seeds the in-memory log store with the sample user 123456.
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	for _, fn := range []string{logstore.HighlightsFile, logstore.NamesFile} {
+		b, err := os.ReadFile("../../data/aigogo/123456/" + fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logs.Write(ctx, "123456", fn, b)
+	}
+	const bn = "log-2024-08-04T02:25:10.513Z"
+	logs.Put(ctx, "123456", bn, logstore.Transcript, []byte("I went to the market."))
+	created, _ := logstore.EntryTime(bn)
+	logs.PutMeta(ctx, "123456", bn, logstore.Meta{Neighborhood: "Bukit Timah", PrimaryHighlight: "Shopping",
+		People: []string{"Ah Hock"}, Created: created, Updated: created, Source: "text"})
+	logs.Put(ctx, "123456", bn, logstore.Summary, []byte("A trip to the market with Ah Hock."))
+	os.Exit(m.Run())
+}
+
 func TestPersonalLogEntries(t *testing.T) {
-	le := personalLogEntries("123456")
+	le := personalLogEntries(context.Background(), "123456")
 	if n := len(le); n == 0 {
 		t.Errorf("number of entries: %v should not be zero", n)
 	}
 }
 
 func TestRandSlection(t *testing.T) {
-	list := personalLogEntries("123456")
+	list := personalLogEntries(context.Background(), "123456")
 	sample := randSelection(list, 5)
 	if len(sample) == 0 {
 		t.Errorf("sample:%#v should not be empty", sample)
 	}
 }
 
-func TestLogBasename(t *testing.T) {
-	fn := "log-2024-08-04T02:25:10.513Z.summary.txt"
-	if bn := logBasename(fn); bn != "log-2024-08-04T02:25:10.513Z" {
-		t.Errorf("basename should not be %s", bn)
+func TestGetLogEntries(t *testing.T) {
+	logEntr := randSelection(personalLogEntries(context.Background(), "123456"), 5)
+	s := getLogEntries(context.Background(), logEntr, "123456")
+	if !strings.Contains(s, "log-2024-08-04T02:25:10.513Z:\nI went to the market.\nWhere: Bukit Timah. Highlights: Shopping. With: Ah Hock.") {
+		t.Errorf("%s: should contain the entry and its metadata", s)
 	}
 }
 
-func TestGetLogEntries(t *testing.T) {
-	logEntr := randSelection(personalLogEntries("123456"), 5)
-	s := getLogEntries(logEntr, "123456")
-	if s == "" {
-		t.Errorf("%s: should not be empty", s)
+func TestSaveEditedLog(t *testing.T) {
+	const bn = "log-2024-09-01T08:00:00.000Z"
+	ctx := context.Background()
+	logs.Put(ctx, "u-edit", bn, logstore.Audio, []byte("ogg data"))
+	r := httptest.NewRequest("POST", "/data?userID=u-edit&editedlog="+bn+
+		"&latlng=1.35,103.76&neighborhood=Holland+Village,+Singapore&primary=Place:+cafe&people=Ah+Hock,+Mei+Ling",
+		strings.NewReader("Coffee with friends."))
+	if got := string(saveEditedLog(httptest.NewRecorder(), r)); got != "Coffee with friends." {
+		t.Errorf("returned %q", got)
+	}
+	if b, _ := logs.Get(ctx, "u-edit", bn, logstore.Transcript); string(b) != "Coffee with friends." {
+		t.Errorf("transcript should have no metadata: %q", b)
+	}
+	m, err := logs.GetMeta(ctx, "u-edit", bn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, _ := logstore.EntryTime(bn)
+	if m.Neighborhood != "Holland Village, Singapore" || m.PrimaryHighlight != "Place: cafe" ||
+		strings.Join(m.People, "|") != "Ah Hock|Mei Ling" || m.Location == nil || m.Location.Lng != 103.76 ||
+		m.Source != "audio" || !m.Created.Equal(created) || m.Updated.IsZero() {
+		t.Errorf("meta: %+v", m)
 	}
 }
 
@@ -65,13 +163,13 @@ func TestPages(t *testing.T) {
 		testPage(t, indexFunc, "/", "<h1>AiGoGo")
 	})
 	t.Run("MemoryGen", func(t *testing.T) {
-		testPage(t, memGenFunc, "/memories?userID=123456", "calling GenerateContentStream")
+		testPage(t, memGenFunc, "/memories?userID=123456", "fake response:")
 	})
 	t.Run("LogDetails", func(t *testing.T) {
 		testPage(t, personalLogDetails, "/ref?userID=123456&log=log-somedate", "populating log details")
 	})
 	t.Run("RetrieveAugmentDoc", func(t *testing.T) {
-		testPage(t, retrievalFunc, "/retr?userPrompt=someprompt", "calling augmentGenerationWithDoc: [testDoc1 testDoc2]")
+		testPage(t, retrievalFunc, "/retr?userPrompt=someprompt&ctx=General&latlng=1.35,103.76", "fake response: someprompt")
 	})
 	t.Run("Location", func(t *testing.T) {
 		testPage(t, locationFunc, "/loc?latlng=1.23,4.56", "123 A Street, B City")
@@ -109,8 +207,8 @@ func testPage(t *testing.T, fn func(w http.ResponseWriter, r *http.Request), pat
 
 func TestHandlers(t *testing.T) {
 	tmpl = template.Must(template.ParseGlob("./internal/public/*.html"))
-	t.Run("UserIDExist",func(t*testing.T){
-		testHandler(t,userIDExistFunc,"GET","/userIDExist?userID=123456",nil,"Kit Siew")
+	t.Run("UserIDExist", func(t *testing.T) {
+		testHandler(t, userIDExistFunc, "GET", "/userIDExist?userID=123456", nil, "Kit Siew")
 	})
 }
 
@@ -125,3 +223,1348 @@ func testHandler(t *testing.T, fn http.HandlerFunc, method string, path string,
 		t.Errorf("expected fragment: %s: got:%s", fragment, bd)
 	}
 }
+
+// useFake installs a fresh fake LLM backend for the duration of the test.
+func useFake(t *testing.T, reply func(gen.Call) []string) *gen.Fake {
+	f := &gen.Fake{Reply: reply}
+	old := llm
+	llm = f
+	t.Cleanup(func() { llm = old })
+	return f
+}
+
+func TestPromptAssembly(t *testing.T) {
+	t.Run("Retrieval", func(t *testing.T) {
+		f := useFake(t, nil)
+		testHandler(t, retrievalFunc, "GET", "/retr?userPrompt=songs+about+sheep&ctx=General&latlng=1.35,103.76&loc=Clementi&weather=sunny", nil, "fake response: songs about sheep")
+		c := f.Calls()
+		if len(c) != 1 || !c[0].Stream {
+			t.Fatalf("expected one streaming call: %#v", c)
+		}
+		for _, want := range []string{"RESOURCE 1: songs about lambs or sheep", "Clementi", "sunny", "timezone: UTC"} {
+			if !strings.Contains(c[0].SystemInstruction, want) {
+				t.Errorf("system instruction missing %q: %s", want, c[0].SystemInstruction)
+			}
+		}
+	})
+	t.Run("Memories", func(t *testing.T) {
+		f := useFake(t, nil)
+		testHandler(t, memGenFunc, "GET", "/memgen?userID=123456&userPrompt=wedding", nil, "fake response: wedding")
+		c := f.Calls()
+		if len(c) != 1 || !strings.Contains(c[0].Prompt, "log-") {
+			t.Errorf("prompt should include log entries: %#v", c)
+		}
+		if !strings.Contains(c[0].SystemInstruction, "bubbly and cheerful") {
+			t.Errorf("unexpected system instruction: %s", c[0].SystemInstruction)
+		}
+	})
+	t.Run("StreamChunks", func(t *testing.T) {
+		useFake(t, func(gen.Call) []string { return []string{"one ", "two ", "three"} })
+		testHandler(t, life, "GET", "/life?latlng=1.35,103.76&loc=Clementi", nil, "one two three")
+	})
+	t.Run("RenderError", func(t *testing.T) {
+		f := useFake(t, nil)
+		dir := t.TempDir()
+		// parses, as the test render has no location, but fails with one
+		os.WriteFile(dir+"/philosopher.tmpl", []byte("{{/* version: 9 */}}{{if .Location}}{{index .Resources 9}}{{end}}"), 0644)
+		old := prompts
+		t.Cleanup(func() { prompts = old })
+		var err error
+		if prompts, err = prompt.Load(dir); err != nil {
+			t.Fatal(err)
+		}
+		testHandler(t, life, "GET", "/life?latlng=1.35,103.76&loc=Clementi", nil, errPrompt.Error())
+		if c := f.Calls(); len(c) != 0 {
+			t.Errorf("the model should not be called without a system instruction: %#v", c)
+		}
+	})
+}
+
+func TestConcurrentHandlers(t *testing.T) {
+	// the fake replies with the system instruction and prompt it received, so any
+	// leakage between concurrent requests shows up in the response body.
+	useFake(t, func(c gen.Call) []string { return []string{c.SystemInstruction, "\n", c.Prompt} })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/retr", retrievalFunc)
+	mux.HandleFunc("/life", life)
+	mux.HandleFunc("/memgen", memGenFunc)
+	mux.HandleFunc("/data", dataWrite)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		path     string
+		fragment string
+	}{
+		{"/retr?userPrompt=prompt{i}&ctx=General&latlng=1.35,103.76&loc=place{i}", "place{i}"},
+		{"/life?latlng=1.35,103.76&loc=place{i}", "place{i}"},
+		{"/memgen?userID=123456&userPrompt=prompt{i}", "prompt{i}"},
+		{"/data?filename=somefile&userID=123456", "calling saveAudioFile and transcribeAudio"},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, tc := range tests {
+			wg.Add(1)
+			n := strconv.Itoa(i)
+			go func(path, fragment string) {
+				defer wg.Done()
+				res, err := http.Get(ts.URL + path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer res.Body.Close()
+				body, _ := io.ReadAll(res.Body)
+				if !bytes.Contains(body, []byte(fragment)) {
+					t.Errorf("%s: expected fragment: %s not found in body: %s", path, fragment, body)
+				}
+				for j := 0; j < 10; j++ {
+					if j != i && bytes.Contains(body, []byte(fmt.Sprintf("place%d", j))) {
+						t.Errorf("%s: leaked place%d into body: %s", path, j, body)
+					}
+				}
+			}(strings.ReplaceAll(tc.path, "{i}", n), strings.ReplaceAll(tc.fragment, "{i}", n))
+		}
+	}
+	wg.Wait()
+}
+
+func TestPersistentDB(t *testing.T) {
+	oldDB, oldColl := db, collection
+	t.Cleanup(func() { db, collection = oldDB, oldColl })
+	t.Setenv("VECDB_PATH", t.TempDir())
+
+	c := initDB()
+	n := c.Count()
+	if n == 0 {
+		t.Fatal("embeddings.gob should be imported into an empty database")
+	}
+	if err := c.AddDocument(context.Background(), chromem.Document{ID: "new", Content: "Kopi at Serangoon Road", Metadata: map[string]string{"context": "Singapore"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c = initDB()
+	if c.Count() != n+1 {
+		t.Errorf("reopened database should keep added document without reimport: got %d documents, expected %d", c.Count(), n+1)
+	}
+}
+
+func TestKnowledgeBaseAPI(t *testing.T) {
+	oldKB := kb
+	t.Cleanup(func() { kb = oldKB })
+	c, err := chromem.NewDB().CreateCollection("kbtest", nil, emb.Embed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb = newKnowledgeBase(c)
+	t.Setenv("KB_TOKEN", "secret")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kb", requireKBToken(kbListFunc))
+	mux.HandleFunc("POST /kb", requireKBToken(kbCreateFunc))
+	mux.HandleFunc("GET /kb/{id}", requireKBToken(kbGetFunc))
+	mux.HandleFunc("PUT /kb/{id}", requireKBToken(kbUpdateFunc))
+	mux.HandleFunc("DELETE /kb/{id}", requireKBToken(kbDeleteFunc))
+	do := func(method, path, token, body string) (int, string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	if code, _ := do("GET", "/kb", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("bad token: status %d, expected %d", code, http.StatusUnauthorized)
+	}
+	if code, body := do("POST", "/kb", "secret", `{"ID":"t1","Title":"Lor Bak","Content":"Try the lor bak at Kimberley Street","Context":"Penang"}`); code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", code, body)
+	}
+	if code, _ := do("POST", "/kb", "secret", `{"ID":"t1","Title":"dup","Content":"dup","Context":"Penang"}`); code != http.StatusConflict {
+		t.Errorf("duplicate create: status %d, expected %d", code, http.StatusConflict)
+	}
+	if code, body := do("PUT", "/kb/t1", "secret", `{"Title":"Lor Bak","Content":"Kimberley Street lor bak, open evenings","Context":"Penang"}`); code != http.StatusOK {
+		t.Errorf("update: status %d: %s", code, body)
+	}
+	if _, body := do("GET", "/kb?context=Penang", "secret", ""); !strings.Contains(body, "open evenings") {
+		t.Errorf("list should contain updated document: %s", body)
+	}
+	if _, body := do("GET", "/kb?context=Ipoh", "secret", ""); body != "[]" {
+		t.Errorf("list of other context should be empty: %s", body)
+	}
+	if c.Count() != 1 {
+		t.Errorf("collection count: %d, expected 1", c.Count())
+	}
+	if code, _ := do("DELETE", "/kb/t1", "secret", ""); code != http.StatusNoContent {
+		t.Errorf("delete: status %d", code)
+	}
+	if code, _ := do("GET", "/kb/t1", "secret", ""); code != http.StatusNotFound {
+		t.Errorf("get deleted: status %d", code)
+	}
+	if c.Count() != 0 {
+		t.Errorf("collection count after delete: %d, expected 0", c.Count())
+	}
+	if code, _ := do("PUT", "/kb/t1", "secret", `{"Title":"Lor Bak","Content":"gone","Context":"Penang"}`); code != http.StatusNotFound {
+		t.Errorf("update deleted: status %d", code)
+	}
+
+	// Concurrent creates of the same ID: one succeeds, the rest conflict.
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := do("POST", "/kb", "secret", fmt.Sprintf(`{"ID":"race","Title":"t%d","Content":"c","Context":"Penang"}`, i))
+			codes <- code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("concurrent create: status %d", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("concurrent creates: %d succeeded, expected 1", created)
+	}
+
+	// Readers are not held up while a document is embedded.
+	oldEmb := emb
+	be := blockingEmbedder{emb, make(chan struct{}), make(chan struct{})}
+	emb = be
+	t.Cleanup(func() { emb = oldEmb })
+	posted := make(chan int)
+	go func() {
+		code, _ := do("POST", "/kb", "secret", `{"ID":"slow","Title":"Slow","Content":"c","Context":"Penang"}`)
+		posted <- code
+	}()
+	<-be.started
+	read := make(chan int)
+	go func() {
+		code, _ := do("GET", "/kb/race", "secret", "")
+		read <- code
+	}()
+	select {
+	case code := <-read:
+		if code != http.StatusOK {
+			t.Errorf("read during embedding: status %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Error("read blocked by an embedding in progress")
+	}
+	close(be.release)
+	if code := <-posted; code != http.StatusCreated {
+		t.Errorf("slow create: status %d", code)
+	}
+}
+
+// blockingEmbedder signals started when asked to embed and embeds once release is closed.
+type blockingEmbedder struct {
+	embedder.Embedder
+	started, release chan struct{}
+}
+
+func (e blockingEmbedder) Embed(ctx context.Context, s string) ([]float32, error) {
+	e.started <- struct{}{}
+	<-e.release
+	return e.Embedder.Embed(ctx, s)
+}
+
+func TestKnowledgeBaseIndex(t *testing.T) {
+	if n := len(kb.list("")); n != collection.Count() {
+		t.Errorf("index has %d documents, collection has %d", n, collection.Count())
+	}
+	for _, d := range kb.list("General") {
+		if d.Title == "" || strings.Contains(d.Content, " | ") {
+			t.Errorf("title and content not recovered: %#v", d)
+		}
+	}
+}
+
+func TestRetrievalConfig(t *testing.T) {
+	old := retrievalConfigs
+	t.Cleanup(func() { retrievalConfigs = old })
+	load := func(config string) {
+		fn := filepath.Join(t.TempDir(), "retrieval.json")
+		os.WriteFile(fn, []byte(config), 0644)
+		t.Setenv("RETRIEVAL_CONFIG", fn)
+		loadRetrievalConfigs()
+	}
+
+	load(`{"default": {"minSimilarity": 0.1}, "Penang": {"k": 5, "minKeywordMatch": 0.6}, "Quiet": {"k": 0}}`)
+	tests := []struct {
+		path string
+		want retrievalConfig
+	}{
+		{"/retr?ctx=General", retrievalConfig{K: 2, MinSimilarity: 0.1, MinKeywordMatch: 0.4}},
+		{"/retr?ctx=Penang", retrievalConfig{K: 5, MinSimilarity: 0.1, MinKeywordMatch: 0.6}},
+		{"/retr?ctx=Quiet", retrievalConfig{K: 0, MinSimilarity: 0.1, MinKeywordMatch: 0.4}},
+		{"/retr?ctx=Penang&k=1&minSim=0.5&minKw=0", retrievalConfig{K: 1, MinSimilarity: 0.5}},
+		{"/retr?ctx=Penang&k=100", retrievalConfig{K: maxK, MinSimilarity: 0.1, MinKeywordMatch: 0.6}},
+	}
+	for _, tc := range tests {
+		if got := retrievalConfigFor(httptest.NewRequest("GET", tc.path, nil)); got != tc.want {
+			t.Errorf("%s: got %+v, expected %+v", tc.path, got, tc.want)
+		}
+	}
+
+	load(`{"default": {"k": 3}}`)
+	if got := retrievalConfigFor(httptest.NewRequest("GET", "/retr?ctx=General", nil)); got != (retrievalConfig{K: 3, MinKeywordMatch: 0.4}) {
+		t.Errorf("default k only: got %+v", got)
+	}
+}
+
+func TestSparseRetrieval(t *testing.T) {
+	f := useFake(t, nil)
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{"NoDocuments", "/retr?userPrompt=hi&ctx=Nowhere&latlng=1.35,103.76", []string{"no RESOURCES"}},
+		{"FewerThanK", "/retr?userPrompt=growing+succulents&ctx=Plants&k=10&latlng=1.35,103.76", []string{"Below are 3 RESOURCES", "RESOURCE 3:"}},
+		{"OneDocument", "/retr?userPrompt=growing+succulents&ctx=Plants&k=1&latlng=1.35,103.76", []string{"Below are 1 RESOURCES", "RESOURCE 1: Growing Succulents"}},
+		{"Threshold", "/retr?userPrompt=xyzzy+plover&ctx=Plants&minSim=0.99&latlng=1.35,103.76", []string{"no RESOURCES"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f.Reset()
+			testHandler(t, retrievalFunc, "GET", tc.path, nil, "fake response:")
+			c := f.Calls()
+			if len(c) != 1 {
+				t.Fatalf("expected one call, got %d", len(c))
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(c[0].SystemInstruction, want) {
+					t.Errorf("system instruction missing %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestHybridRetrieval(t *testing.T) {
+	oldKB := kb
+	t.Cleanup(func() { kb = oldKB })
+	c, _ := chromem.NewDB().CreateCollection("hybrid", nil, emb.Embed)
+	kb = newKnowledgeBase(c)
+	ctx := context.Background()
+	for _, d := range []rag.Doc{
+		{ID: "1", Title: "Lor Bak", Content: "Kimberley Street, evenings only.", Context: "Penang"},
+		{ID: "2", Title: "Lor Mee", Content: "Thick noodles in gravy at New Lane.", Context: "Penang"},
+		{ID: "3", Title: "Bak Kut Teh", Content: "Herbal pork rib soup.", Context: "Penang"},
+		{ID: "4", Title: "Hawker food", Content: "Many stalls selling noodles and meat.", Context: "Penang"},
+		{ID: "5", Title: "Lor Bak", Content: "Ipoh old town.", Context: "Ipoh"},
+	} {
+		if _, err := kb.create(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldColl := collection
+	collection = c
+	t.Cleanup(func() { collection = oldColl })
+
+	res := retrieveDocsForAugmentation(httptest.NewRequest("GET", "/retr?ctx=Penang&k=2", nil), "Where can I eat Lor Bak?")
+	if len(res) != 2 || res[0].ID != "1" {
+		t.Fatalf("exact name match should rank first: %+v", res)
+	}
+	if res[0].KeywordRank != 1 || res[0].VectorRank == 0 || res[0].Score <= res[1].Score {
+		t.Errorf("unexpected fused scores: %+v", res)
+	}
+
+	w := httptest.NewRecorder()
+	writeRetrievalDebug(w, res)
+	if !strings.Contains(w.Body.String(), "1, ") || !strings.Contains(w.Body.String(), "Lor Bak") {
+		t.Errorf("debug output should list per-retriever scores: %s", w.Body.String())
+	}
+
+	// Without vector results, a one-word overlap, Lor Mee, is not retrieved.
+	res = retrieveDocsForAugmentation(httptest.NewRequest("GET", "/retr?ctx=Penang&k=4&minSim=0.99", nil), "Where can I eat Lor Bak?")
+	if len(res) != 1 || res[0].ID != "1" {
+		t.Errorf("only the full keyword match should be retrieved: %+v", res)
+	}
+	if res := retrieveDocsForAugmentation(httptest.NewRequest("GET", "/retr?ctx=Penang&k=4&minSim=0.99&minKw=0", nil), "Where can I eat Lor Bak?"); len(res) != 3 {
+		t.Errorf("every keyword match should be retrieved with minKw=0: %+v", res)
+	}
+
+	// A keyword hit deleted before fusion is skipped.
+	kw := []bm25.Result{{ID: "gone", Score: 9}, {ID: "2", Score: 1}}
+	if res := fuse(nil, kw, retrievalConfig{K: 2}); len(res) != 1 || res[0].ID != "2" || res[0].Content == "" {
+		t.Errorf("deleted keyword hit should be skipped: %+v", res)
+	}
+}
+
+func TestSourceCitations(t *testing.T) {
+	useFake(t, nil)
+	oldKB, oldColl := kb, collection
+	t.Cleanup(func() { kb, collection = oldKB, oldColl })
+	c, _ := chromem.NewDB().CreateCollection("citations", nil, emb.Embed)
+	kb, collection = newKnowledgeBase(c), c
+	ctx := context.Background()
+	for _, d := range []rag.Doc{
+		{ID: "pg-1", Title: "Gurney Drive", Content: "Poorly lit at night, take care on the steps.", Context: "Penang"},
+		{ID: "pg-2", Title: "Café Lorong", Content: "Quiet café with kopi and kaya toast.", Context: "Penang"},
+	} {
+		if _, err := kb.create(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	retrievalFunc(w, httptest.NewRequest("GET", "/retr?userPrompt=walk+at+Gurney+Drive&ctx=Penang&latlng=5.4,100.3", nil))
+	hdr := w.Header().Get(sourcesHeader)
+	for _, r := range hdr {
+		if r >= utf8.RuneSelf {
+			t.Fatalf("header should be ASCII: %s", hdr)
+		}
+	}
+	var s []source
+	if err := json.Unmarshal([]byte(hdr), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2 || s[0].ID != "pg-1" || s[0].Title != "Gurney Drive" || s[0].Context != "Penang" || s[0].Similarity == nil {
+		t.Errorf("unexpected sources: %s", hdr)
+	}
+	if s[1].Title != "Café Lorong" {
+		t.Errorf("non-ASCII title not round-tripped: %s", s[1].Title)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /doc/{id}", docFunc)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/doc/pg-1", nil))
+	var d rag.Doc
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil || d.Content != "Poorly lit at night, take care on the steps." {
+		t.Errorf("cited document: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/doc/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing document: got %d", w.Code)
+	}
+}
+
+type sseEvent struct {
+	name, data string
+}
+
+func sseEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	ev := []sseEvent{}
+	for _, blk := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		name, data, ok := strings.Cut(blk, "\n")
+		if !ok || !strings.HasPrefix(name, "event: ") || !strings.HasPrefix(data, "data: ") {
+			t.Fatalf("malformed event: %q", blk)
+		}
+		ev = append(ev, sseEvent{strings.TrimPrefix(name, "event: "), strings.TrimPrefix(data, "data: ")})
+	}
+	return ev
+}
+
+// blockedIterator yields one chunk and then reports a safety block.
+type blockedIterator struct{ n int }
+
+func (it *blockedIterator) Next() (*genai.GenerateContentResponse, error) {
+	it.n++
+	if it.n == 1 {
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: genai.NewUserContent(genai.Text("partial "))}}}, nil
+	}
+	return nil, &genai.BlockedError{Candidate: &genai.Candidate{
+		FinishReason:  genai.FinishReasonSafety,
+		SafetyRatings: []*genai.SafetyRating{{Category: genai.HarmCategoryDangerousContent, Probability: genai.HarmProbabilityHigh, Blocked: true}},
+	}}
+}
+
+func (it *blockedIterator) MergedResponse() *genai.GenerateContentResponse { return nil }
+
+func TestSSE(t *testing.T) {
+	useFake(t, func(gen.Call) []string { return []string{"one ", "two ", "three"} })
+
+	t.Run("Retrieval", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		retrievalFunc(w, httptest.NewRequest("GET", "/retr?userPrompt=songs&ctx=General&latlng=1.35,103.76&stream=sse", nil))
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("content type: %s", ct)
+		}
+		ev := sseEvents(t, w.Body.String())
+		names := []string{}
+		text := ""
+		for _, e := range ev {
+			names = append(names, e.name)
+			if e.name == "token" {
+				var te textEvent
+				json.Unmarshal([]byte(e.data), &te)
+				text += te.Text
+			}
+		}
+		if got := strings.Join(names, ","); got != "response,sources,token,token,token,finish,usage" {
+			t.Errorf("events: %s", got)
+		}
+		if text != "one two three" {
+			t.Errorf("tokens: %q", text)
+		}
+		if ev[0].data != fmt.Sprintf(`{"id":%q}`, w.Header().Get("X-Response-ID")) {
+			t.Errorf("response: %s", ev[0].data)
+		}
+		if ev[5].data != `{"reason":"Stop"}` {
+			t.Errorf("finish: %s", ev[5].data)
+		}
+		var u usageEvent
+		if err := json.Unmarshal([]byte(ev[6].data), &u); err != nil || u.CandidatesTokens != 3 || u.TotalTokens != u.PromptTokens+3 {
+			t.Errorf("usage: %s", ev[6].data)
+		}
+	})
+
+	t.Run("AcceptHeader", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/life?latlng=1.35,103.76&loc=Clementi", nil)
+		r.Header.Set("Accept", "text/event-stream")
+		life(w, r)
+		if ev := sseEvents(t, w.Body.String()); ev[1].name != "token" || ev[len(ev)-1].name != "usage" {
+			t.Errorf("events: %+v", ev)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		memGenFunc(w, httptest.NewRequest("GET", "/memgen?stream=sse", nil))
+		if ev := sseEvents(t, w.Body.String()); len(ev) != 2 || ev[1].name != "error" {
+			t.Errorf("events: %+v", ev)
+		}
+	})
+
+	t.Run("Blocked", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		newStream(w, httptest.NewRequest("GET", "/retr?stream=sse", nil), "%v").copy(&blockedIterator{})
+		ev := sseEvents(t, w.Body.String())
+		if len(ev) != 4 || ev[1].name != "token" || ev[2].name != "safety" || ev[3].name != "error" {
+			t.Fatalf("events: %+v", ev)
+		}
+		var sf safetyEvent
+		if err := json.Unmarshal([]byte(ev[2].data), &sf); err != nil || !sf.Blocked || sf.Ratings[0].Category != "DangerousContent" {
+			t.Errorf("safety: %s", ev[2].data)
+		}
+
+		w = httptest.NewRecorder()
+		newStream(w, httptest.NewRequest("GET", "/retr", nil), "<p>I've encounted an issue: %v:").copy(&blockedIterator{})
+		if got := w.Body.String(); !strings.HasPrefix(got, "partial <p>I've encounted an issue: blocked: candidate: FinishReasonSafety:") ||
+			!strings.Contains(got, "blocked: true") {
+			t.Errorf("plain text: %s", got)
+		}
+	})
+}
+
+func TestConversations(t *testing.T) {
+	f := useFake(t, func(c gen.Call) []string { return []string{fmt.Sprintf("reply %d", len(c.History)/2+1)} })
+	old := conversations
+	conversations = newConversationStore(time.Hour)
+	t.Cleanup(func() { conversations = old })
+
+	t.Setenv("LOG_TOKEN", "secret")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/retr", retrievalFunc)
+	mux.HandleFunc("GET /conversations", requireLogToken(conversationListFunc))
+	mux.HandleFunc("DELETE /conversations", requireLogToken(conversationClearFunc))
+	mux.HandleFunc("GET /conversations/{id}", requireLogToken(conversationGetFunc))
+	mux.HandleFunc("DELETE /conversations/{id}", requireLogToken(conversationDeleteFunc))
+	do := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/retr?userID=u1&userPrompt=hi&ctx=General&latlng=1.35,103.76"); w.Header().Get("X-Conversation") != "" || len(conversations.list("u1")) != 0 {
+		t.Errorf("a request without conv should not start a conversation")
+	}
+	f.Reset()
+	w := do("GET", "/retr?userID=u1&conv=new&userPrompt=sing+a+song&ctx=General&latlng=1.35,103.76")
+	id := w.Header().Get("X-Conversation")
+	if id == "" || w.Body.String() != "reply 1" {
+		t.Fatalf("first turn: %q %q", id, w.Body.String())
+	}
+	w = do("GET", "/retr?userID=u1&conv="+id+"&userPrompt=another+one&ctx=General&latlng=1.35,103.76")
+	if w.Body.String() != "reply 2" {
+		t.Errorf("second turn: %q", w.Body.String())
+	}
+	c := f.Calls()
+	if len(c) != 2 || len(c[1].History) != 2 || gen.ContentText(c[1].History[0]) != "sing a song" || c[1].Prompt != "another one" {
+		t.Errorf("second turn should carry the first: %+v", c[len(c)-1])
+	}
+	if !strings.Contains(c[1].SystemInstruction, "RESOURCES") {
+		t.Errorf("each turn should have its own system instruction")
+	}
+
+	var l []conversationSummary
+	json.Unmarshal(do("GET", "/conversations?userID=u1").Body.Bytes(), &l)
+	if len(l) != 1 || l[0].ID != id || l[0].Turns != 2 || l[0].Title != "sing a song" {
+		t.Errorf("list: %+v", l)
+	}
+	var d conversationDetail
+	json.Unmarshal(do("GET", "/conversations/"+id+"?userID=u1").Body.Bytes(), &d)
+	if len(d.History) != 4 || d.History[3] != (turn{Role: "model", Text: "reply 2"}) {
+		t.Errorf("history: %+v", d.History)
+	}
+
+	if w := do("GET", "/conversations/"+id+"?userID=u2"); w.Code != http.StatusNotFound {
+		t.Errorf("other user's conversation: got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/conversations/"+id+"?userID=u1", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without the token: got %d", w.Code)
+	}
+	if w := do("GET", "/retr?userID=u1&conv=nope&userPrompt=hi"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown conversation: got %d", w.Code)
+	}
+	if w := do("DELETE", "/conversations/"+id+"?userID=u1"); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d", w.Code)
+	}
+
+	do("GET", "/retr?userID=u1&conv=new&userPrompt=one&ctx=General&latlng=1.35,103.76")
+	do("GET", "/retr?userID=u1&conv=new&userPrompt=two&ctx=General&latlng=1.35,103.76")
+	if w := do("DELETE", "/conversations?userID=u1"); w.Code != http.StatusNoContent || len(conversations.list("u1")) != 0 {
+		t.Errorf("clear: got %d", w.Code)
+	}
+
+	// Concurrent turns in the same conversation are both kept.
+	f.Reply = func(c gen.Call) []string { return []string{"reply to " + c.Prompt} }
+	id = do("GET", "/retr?userID=u1&conv=new&userPrompt=start&ctx=General&latlng=1.35,103.76").Header().Get("X-Conversation")
+	var loaded sync.WaitGroup
+	loaded.Add(2)
+	f.Reply = func(c gen.Call) []string {
+		loaded.Done()
+		loaded.Wait() // both turns have loaded the history
+		return []string{"reply to " + c.Prompt}
+	}
+	var turns sync.WaitGroup
+	for _, p := range []string{"tab+one", "tab+two"} {
+		turns.Add(1)
+		go func() {
+			defer turns.Done()
+			do("GET", "/retr?userID=u1&conv="+id+"&userPrompt="+p+"&ctx=General&latlng=1.35,103.76")
+		}()
+	}
+	turns.Wait()
+	conv, _ := conversations.get("u1", id)
+	texts := []string{}
+	for _, h := range conv.History {
+		texts = append(texts, gen.ContentText(h))
+	}
+	if got := strings.Join(texts, "|"); len(conv.History) != 6 || !strings.Contains(got, "reply to tab one") || !strings.Contains(got, "reply to tab two") {
+		t.Errorf("concurrent turns should both be kept: %s", got)
+	}
+
+	s := newConversationStore(time.Hour)
+	for i := range maxConversations + 1 {
+		s.addTurn(conversation{ID: fmt.Sprint("c", i), UserID: "u1"})
+	}
+	s.addTurn(conversation{ID: "other", UserID: "u2"})
+	if _, ok := s.get("u1", "c0"); ok || len(s.list("u1")) != maxConversations || len(s.list("u2")) != 1 {
+		t.Errorf("only the %d most recent conversations of a user should be kept", maxConversations)
+	}
+
+	s = newConversationStore(time.Millisecond)
+	s.addTurn(conversation{ID: "c", UserID: "u1"})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := s.get("u1", "c"); ok {
+		t.Error("conversation should have expired")
+	}
+}
+
+func TestExperiments(t *testing.T) {
+	f := useFake(t, func(c gen.Call) []string { return []string{c.SystemInstruction} })
+	dir := t.TempDir()
+	os.WriteFile(dir+"/caregiver.warm.tmpl", []byte("{{/* version: 7 */}}WARM caregiver"), 0644)
+	oldPrompts, oldExp, oldResp := prompts, experiments, responses
+	t.Cleanup(func() { prompts, experiments, responses = oldPrompts, oldExp, oldResp })
+	var err error
+	if prompts, err = prompt.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	e := experiment{Variants: []string{"caregiver", "caregiver.warm"}}
+	if err := e.check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (experiment{Variants: []string{"caregiver.nope"}}).check(); err == nil {
+		t.Error("unknown template should fail the check")
+	}
+	experiments = map[string]experiment{"caregiver": e}
+	responses = openResponseLog(dir + "/responses.jsonl")
+
+	// find a user in each variant
+	users := map[string]string{}
+	for i := 0; i < 50; i++ {
+		u := fmt.Sprintf("user%d", i)
+		v := variantFor("caregiver", u)
+		if v != variantFor("caregiver", u) {
+			t.Fatal("assignment should be deterministic")
+		}
+		users[v] = u
+	}
+	if len(users) != 2 {
+		t.Fatalf("users should be split between variants: %v", users)
+	}
+	if variantFor("caregiver", "") != "caregiver" || variantFor("philosopher", "user1") != "philosopher" {
+		t.Error("anonymous users and templates without experiments should get the control")
+	}
+	if v := (experiment{Variants: []string{"a", "b"}, Weights: []int{1, 0}}).assign("x", users["caregiver.warm"]); v != "a" {
+		t.Errorf("zero weight variant assigned: %s", v)
+	}
+
+	w := httptest.NewRecorder()
+	retrievalFunc(w, httptest.NewRequest("GET", "/retr?userPrompt=hi&ctx=General&latlng=1.35,103.76&userID="+users["caregiver.warm"], nil))
+	c := f.Calls()
+	if c[len(c)-1].SystemInstruction != "WARM caregiver" {
+		t.Errorf("variant not used: %s", c[len(c)-1].SystemInstruction)
+	}
+	id := w.Header().Get("X-Response-ID")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /feedback", feedbackFunc)
+	mux.HandleFunc("GET /experiments/export", requireAdminToken(experimentExportFunc))
+	post := func(form string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/feedback", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := post("responseID=" + id + "&rating=1&comment=lovely"); code != http.StatusNoContent {
+		t.Errorf("feedback: got %d", code)
+	}
+	if code := post("responseID=nope&rating=1"); code != http.StatusNotFound {
+		t.Errorf("unknown response: got %d", code)
+	}
+	if code := post("responseID=" + id + "&rating=good"); code != http.StatusBadRequest {
+		t.Errorf("bad rating: got %d", code)
+	}
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/experiments/export", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	mux.ServeHTTP(w, r)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("export: %v %q", err, rows)
+	}
+	row := strings.Join(rows[1], ",")
+	if strings.Join(rows[0][5:8], ",") != "failed,cancelled,cached" {
+		t.Errorf("export header: %q", rows[0])
+	}
+	for _, want := range []string{id, users["caregiver.warm"], "/retr", "caregiver.warm@7", "false,false,false", "WARM caregiver", ",1,lovely"} {
+		if !strings.Contains(row, want) {
+			t.Errorf("export row missing %q: %s", want, row)
+		}
+	}
+
+	if rec, ok := openResponseLog(dir + "/responses.jsonl").lookup(id); !ok || rec.Prompt != "caregiver.warm@7" {
+		t.Errorf("reopened log should index responses: %+v", rec)
+	}
+
+	t.Run("Bounded", func(t *testing.T) {
+		old := maxIndexedResponses
+		t.Cleanup(func() { maxIndexedResponses = old })
+		maxIndexedResponses = 2
+		l := openResponseLog(t.TempDir() + "/responses.jsonl")
+		for i := 0; i < 5; i++ {
+			l.append(responseRecord{Type: "response", ID: fmt.Sprint(i), Prompt: "caregiver@1"})
+		}
+		if len(l.index) != 2 || len(l.order) != 2 {
+			t.Errorf("index should keep the latest responses: %v", l.index)
+		}
+		if rec, ok := l.lookup("0"); !ok || rec.Prompt != "caregiver@1" {
+			t.Errorf("responses no longer indexed should be found in the file: %+v", rec)
+		}
+		if _, ok := l.lookup("nope"); ok {
+			t.Error("unknown response found")
+		}
+		if r := openResponseLog(l.fn); len(r.index) != 2 || r.index["4"].ID != "4" {
+			t.Errorf("reopened index should keep the latest responses: %v", r.index)
+		}
+	})
+
+	w = httptest.NewRecorder()
+	memGenFunc(w, httptest.NewRequest("GET", "/memgen?userID=123456&userPrompt=market", nil))
+	var mem responseRecord
+	responses.scan(func(rec responseRecord) { mem = rec })
+	if mem.Endpoint != "/memgen" || mem.Request != "market\nentries: log-2024-08-04T02:25:10.513Z" {
+		t.Errorf("memories should be recorded with the entry names only: %+v", mem)
+	}
+
+	responses = openResponseLog("")
+	retrievalFunc(httptest.NewRecorder(), httptest.NewRequest("GET", "/retr?userPrompt=hi&ctx=General&latlng=1.35,103.76&userID=u1", nil))
+	if len(responses.index) != 0 {
+		t.Errorf("responses should not be indexed without a log: %v", responses.index)
+	}
+}
+
+func TestUsageAccounting(t *testing.T) {
+	useFake(t, nil)
+	old := usageLog
+	t.Cleanup(func() { usageLog = old })
+	usageLog, _ = usage.Open("")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/retr", retrievalFunc)
+	mux.HandleFunc("/life", life)
+	for _, url := range []string{
+		"/retr?userPrompt=sing+a+song&ctx=General&latlng=1.35,103.76&userID=u1",
+		"/life?latlng=1.35,103.76&loc=Clementi&userID=u1",
+		"/life?latlng=1.35,103.76&loc=Clementi",
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/usage?by=user,endpoint,model", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	requireAdminToken(usageReportFunc)(w, r)
+	var rows []usage.Row
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	if len(rows) != 3 {
+		t.Fatalf("rows: %+v", rows)
+	}
+	for _, row := range rows {
+		if row.Requests != 1 || row.Model != "fake" || row.PromptTokens == 0 || row.TotalTokens != row.PromptTokens+row.CandidatesTokens {
+			t.Errorf("row: %+v", row)
+		}
+	}
+	if rows[0].UserID != "" || rows[1].UserID != "u1" || rows[1].Endpoint != "/life" || rows[2].Endpoint != "/retr" {
+		t.Errorf("grouping: %+v", rows)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/admin/usage?by=week", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	requireAdminToken(usageReportFunc)(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad dimension: got %d", w.Code)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	n := 0
+	f := useFake(t, func(gen.Call) []string { n++; return []string{"answer ", strconv.Itoa(n)} })
+	old, oldUsage := respCache, usageLog
+	t.Cleanup(func() { respCache, usageLog = old, oldUsage })
+	respCache = gen.NewCache(time.Hour, 10, 1000)
+	usageLog, _ = usage.Open("")
+
+	get := func(h http.HandlerFunc, url string) string {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", url, nil))
+		return w.Body.String()
+	}
+	const retr = "/retr?userPrompt=sing+a+song&ctx=General&latlng=1.35,103.76&loc=Clementi"
+	if a, b := get(retrievalFunc, retr), get(retrievalFunc, retr); a != "answer 1" || b != "answer 1" {
+		t.Errorf("second request should be replayed: %q %q", a, b)
+	}
+	if got := get(retrievalFunc, retr+"&stream=sse"); !strings.Contains(got, `event: token`) || !strings.Contains(got, `"answer "`) || !strings.Contains(got, "event: finish") {
+		t.Errorf("replay should stream events:\n%s", got)
+	}
+	if got := get(retrievalFunc, "/retr?userPrompt=sing+a+song&ctx=General&latlng=1.35,103.76&loc=Jurong"); got != "answer 2" {
+		t.Errorf("different prompt should not hit: %q", got)
+	}
+	if a, b := get(retrievalFunc, strings.Replace(retr, "song", "song+at+random", 1)), get(retrievalFunc, strings.Replace(retr, "song", "song+at+random", 1)); a == b {
+		t.Errorf("random prompts should not be cached: %q %q", a, b)
+	}
+	if a, b := get(life, "/life?latlng=1.35,103.76&loc=Clementi"), get(life, "/life?latlng=1.35,103.76&loc=Clementi"); a != b {
+		t.Errorf("/life should be cached: %q %q", a, b)
+	}
+	if len(f.Calls()) != 5 {
+		t.Errorf("model calls: got %d, want 5", len(f.Calls()))
+	}
+	rows, _ := usageLog.Report(usage.Filter{})
+	if len(rows) != 1 || rows[0].Requests != 5 {
+		t.Errorf("replays should not be counted as usage: %+v", rows)
+	}
+
+	oldConv := conversations
+	t.Cleanup(func() { conversations = oldConv })
+	conversations = newConversationStore(time.Hour)
+	w := httptest.NewRecorder()
+	retrievalFunc(w, httptest.NewRequest("GET", retr+"&userID=u1&conv=new", nil))
+	if got := w.Body.String(); got != "answer 1" || len(f.Calls()) != 5 {
+		t.Errorf("a first turn should be replayed like a one-shot request: %q after %d calls", got, len(f.Calls()))
+	}
+	c, ok := conversations.get("u1", w.Header().Get("X-Conversation"))
+	if !ok || len(c.History) != 2 || gen.ContentText(c.History[0]) != "sing a song" || gen.ContentText(c.History[1]) != "answer 1" {
+		t.Errorf("a replayed first turn should be saved: %+v", c)
+	}
+}
+
+type failingEmbedder struct{ embedder.Embedder }
+
+func (failingEmbedder) Embed(context.Context, string) ([]float32, error) {
+	return nil, status.Error(codes.Unavailable, "embedding service down")
+}
+
+// TestModelFailures checks how handlers report model and embedding failures.
+// The retry, fallback and circuit breaker policy is tested in package gen.
+func TestModelFailures(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "overloaded")
+	policy := gen.Policy{Retries: 1, Backoff: time.Millisecond}
+	use := func(t *testing.T, r *gen.Resilient) {
+		old := llm
+		llm = r
+		t.Cleanup(func() { llm = old })
+	}
+	get := func(url string) string {
+		w := httptest.NewRecorder()
+		retrievalFunc(w, httptest.NewRequest("GET", url, nil))
+		return w.Body.String()
+	}
+	const retr = "/retr?userPrompt=hello&ctx=General&latlng=1.35,103.76&loc=Clementi"
+
+	t.Run("Fallback", func(t *testing.T) {
+		primary := &gen.Fake{Fail: func(gen.Call) error { return unavailable }}
+		fallback := &gen.Fake{Reply: func(gen.Call) []string { return []string{"from fallback"} }}
+		use(t, gen.NewResilient(policy, primary, fallback))
+		if got := get(retr); got != "from fallback" {
+			t.Errorf("got %q", got)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/data", nil)
+		transcribeAudio(r, []byte("ogg"), w)
+		if !strings.Contains(w.Body.String(), "from fallback") {
+			t.Errorf("transcription should fall back: %q", w.Body.String())
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		f := &gen.Fake{Fail: func(gen.Call) error { return unavailable }}
+		use(t, gen.NewResilient(policy, f))
+		ev := sseEvents(t, get(retr+"&stream=sse"))
+		last := ev[len(ev)-1]
+		if last.name != "error" || !strings.Contains(last.data, errUnavailable.Error()) || len(f.Calls()) != 2 {
+			t.Errorf("got %+v after %d calls", last, len(f.Calls()))
+		}
+	})
+
+	t.Run("EmbeddingFailure", func(t *testing.T) {
+		oldKB, oldColl, oldEmb := kb, collection, emb
+		t.Cleanup(func() { kb, collection, emb = oldKB, oldColl, oldEmb })
+		c, _ := chromem.NewDB().CreateCollection("resilience", nil, emb.Embed)
+		kb, collection = newKnowledgeBase(c), c
+		if _, err := kb.create(context.Background(), rag.Doc{ID: "1", Title: "Lor Bak", Content: "Five spice rolls.", Context: "Penang"}); err != nil {
+			t.Fatal(err)
+		}
+		emb = failingEmbedder{emb}
+		res := retrieveDocsForAugmentation(httptest.NewRequest("GET", "/retr?ctx=Penang", nil), "lor bak")
+		if len(res) != 1 || res[0].KeywordRank != 1 || res[0].VectorRank != 0 {
+			t.Errorf("should fall back to keyword search: %+v", res)
+		}
+	})
+}
+
+// cancelWriter cancels the request, as a closed browser tab would, after the first write.
+type cancelWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) Write(b []byte) (int, error) {
+	defer w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w cancelWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestCancellation(t *testing.T) {
+	f := useFake(t, func(gen.Call) []string { return []string{"one ", "two ", "three"} })
+	oldResp, oldUsage := responses, usageLog
+	t.Cleanup(func() { responses, usageLog = oldResp, oldUsage })
+	responses = openResponseLog(t.TempDir() + "/responses.jsonl")
+	usageLog, _ = usage.Open("")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := cancelWriter{httptest.NewRecorder(), cancel}
+	r := httptest.NewRequest("GET", "/retr?userPrompt=hello&userID=u1&ctx=General&latlng=1.35,103.76&loc=Clementi", nil).WithContext(ctx)
+	retrievalFunc(w, r)
+	if got := w.Body.String(); got != "one " || len(f.Calls()) != 1 {
+		t.Errorf("stream should stop when the client goes away: %q", got)
+	}
+
+	recs := []responseRecord{}
+	responses.scan(func(rec responseRecord) { recs = append(recs, rec) })
+	if len(recs) != 1 || !recs[0].Cancelled || recs[0].Failed || recs[0].Response != "one " {
+		t.Errorf("response log: %+v", recs)
+	}
+	rows, _ := usageLog.Report(usage.Filter{})
+	if len(rows) != 1 || rows[0].Requests != 1 || rows[0].Cancelled != 1 {
+		t.Errorf("usage: %+v", rows)
+	}
+
+	t.Run("Deadline", func(t *testing.T) {
+		old := requestTimeout
+		t.Cleanup(func() { requestTimeout = old })
+		requestTimeout = time.Nanosecond
+		w := httptest.NewRecorder()
+		withDeadline(life)(w, httptest.NewRequest("GET", "/life?latlng=1.35,103.76&loc=Clementi", nil))
+		if got := w.Body.String(); !strings.Contains(got, "issue") || !strings.Contains(got, "deadline exceeded") {
+			t.Errorf("a request past its deadline should fail: %q", got)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	old := limiters["generation"]
+	t.Cleanup(func() { limiters["generation"] = old })
+	use := func(rl rateLimit) {
+		l, err := newLimiter(rl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limiters["generation"] = l
+	}
+	var release chan bool
+	h := rateLimited("generation", func(w http.ResponseWriter, r *http.Request) {
+		if release != nil {
+			<-release
+		}
+		io.WriteString(w, "ok")
+	})
+	get := func(userID, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/retr?userID="+userID, nil)
+		r.RemoteAddr = ip + ":1234"
+		h(w, r)
+		return w
+	}
+
+	use(rateLimit{Requests: 2, Per: "1h", IPFactor: 2})
+	for i, c := range []struct {
+		userID, ip string
+		code       int
+	}{
+		{"u1", "10.0.0.1", 200},
+		{"u1", "10.0.0.1", 200},
+		{"u1", "10.0.0.1", 429}, // user limit
+		{"u1", "10.0.0.2", 429}, // from anywhere
+		{"u2", "10.0.0.1", 200},
+		{"u2", "10.0.0.1", 200},
+		{"u3", "10.0.0.1", 429}, // IP limit
+		{"", "10.0.0.1", 429},
+		{"u3", "10.0.0.2", 200},
+	} {
+		w := get(c.userID, c.ip)
+		if w.Code != c.code {
+			t.Errorf("%d: got %d, want %d", i, w.Code, c.code)
+		}
+		if w.Code == 429 {
+			if s, _ := strconv.Atoi(w.Header().Get("Retry-After")); s < 1 || s > 60*30 {
+				t.Errorf("%d: Retry-After should be the time to the next request: %q", i, w.Header().Get("Retry-After"))
+			}
+		}
+	}
+
+	use(rateLimit{Requests: 100, Per: "1s", Concurrent: 1})
+	release = make(chan bool)
+	done := make(chan bool)
+	go func() { get("u1", "10.0.0.1"); close(done) }()
+	for limiters["generation"].busy("user:u1") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := get("u1", "10.0.0.1"); w.Code != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("concurrent request should be limited: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(release)
+	<-done
+	if w := get("u1", "10.0.0.1"); w.Code != 200 {
+		t.Errorf("request after the first completed: %d", w.Code)
+	}
+
+	t.Run("Classes", func(t *testing.T) {
+		for url, want := range map[string]string{
+			"/data?filename=log-1.ogg&userID=u1": "transcription",
+			"/data?editedlog=log-1&userID=u1":    "generation",
+			"/data?ter=pau":                      "",
+		} {
+			if got := dataClass(httptest.NewRequest("POST", url, nil)); got != want {
+				t.Errorf("%s: got %q, want %q", url, got, want)
+			}
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+		if ip := clientIP(r); ip != "192.0.2.1" {
+			t.Errorf("X-Forwarded-For should be ignored without TRUST_PROXY: %s", ip)
+		}
+		t.Setenv("TRUST_PROXY", "1")
+		if ip := clientIP(r); ip != "5.6.7.8" {
+			t.Errorf("got %s", ip)
+		}
+	})
+}
+
+func TestLogList(t *testing.T) {
+	ctx := context.Background()
+	const u = "u-list"
+	put := func(bn, neighborhood, primary, secondary string, people ...string) {
+		logs.Put(ctx, u, bn, logstore.Transcript, []byte("transcript of "+bn))
+		logs.Put(ctx, u, bn, logstore.Summary, []byte("summary of "+bn))
+		if neighborhood != "" {
+			logs.PutMeta(ctx, u, bn, logstore.Meta{Neighborhood: neighborhood, PrimaryHighlight: primary,
+				SecondaryHighlight: secondary, People: people})
+		}
+	}
+	put("log-2024-08-01T09:00:00.000Z", "Clementi", "Shopping", "Food", "Ah Hock")
+	put("log-2024-08-02T09:00:00.000Z", "Bukit Timah, Singapore", "Walk", "", "Ah Hock", "Mei Ling")
+	put("log-2024-08-03T09:00:00.000Z", "", "", "") // saved before metadata files
+	put("log-2024-08-04T09:00:00.000Z", "Clementi", "Food", "Shopping")
+	logs.Put(ctx, u, "log-2024-08-05T09:00:00.000Z", logstore.Transcript, []byte("not yet summarized"))
+
+	t.Setenv("LOG_TOKEN", "secret")
+	list := func(query string) (logPage, int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/logs?userID="+u+"&"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		requireLogToken(logListFunc)(w, r)
+		var p logPage
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return p, w.Code
+	}
+	days := func(p logPage) string {
+		s := []string{}
+		for _, e := range p.Entries {
+			s = append(s, e.Time.Format("02"))
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		query, days string
+		total       int
+	}{
+		{"", "04,03,02,01", 4},
+		{"from=2024-08-02&to=2024-08-03", "03,02", 2},
+		{"to=2024-08-02T09:00:00Z", "02,01", 2},
+		{"primary=food", "04", 1},
+		{"secondary=Shopping", "04", 1},
+		{"highlight=Shopping", "04,01", 2},
+		{"neighborhood=bukit+timah", "02", 1},
+		{"people=Ah+Hock", "02,01", 2},
+		{"people=ah+hock,+mei+ling", "02", 1},
+		{"people=Ah+Hock&from=2024-08-02", "02", 1},
+		{"limit=2", "04,03", 4},
+		{"limit=2&before=log-2024-08-03T09:00:00.000Z", "02,01", 4},
+	}
+	for _, tc := range tests {
+		p, code := list(tc.query)
+		if code != http.StatusOK || days(p) != tc.days || p.Total != tc.total {
+			t.Errorf("%s: got %d %s total %d, want %s total %d", tc.query, code, days(p), p.Total, tc.days, tc.total)
+		}
+	}
+
+	p, _ := list("limit=2")
+	if p.Next != "log-2024-08-03T09:00:00.000Z" || p.Entries[0].Summary != "summary of log-2024-08-04T09:00:00.000Z" ||
+		p.Entries[0].Meta == nil || p.Entries[1].Meta != nil {
+		t.Errorf("first page: %+v", p)
+	}
+	if p, _ := list("limit=2&before=" + p.Next); p.Next != "" {
+		t.Errorf("last page should have no next: %q", p.Next)
+	}
+
+	for _, q := range []string{"from=yesterday", "limit=0", "limit=x"} {
+		if _, code := list(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", q, code)
+		}
+	}
+	w := httptest.NewRecorder()
+	requireLogToken(logListFunc)(w, httptest.NewRequest("GET", "/logs?userID="+u, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without the token: got %d, want 401", w.Code)
+	}
+	t.Setenv("LOG_TOKEN", "")
+	if _, code := list(""); code != http.StatusForbidden {
+		t.Errorf("without LOG_TOKEN set: got %d, want 403", code)
+	}
+	w = httptest.NewRecorder()
+	logListFunc(w, httptest.NewRequest("GET", "/logs", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("missing userID: got %d", w.Code)
+	}
+}
+
+func TestLogSearch(t *testing.T) {
+	f := useFake(t, nil)
+	ctx := context.Background()
+	const u = "u-search"
+	entries := map[string]string{
+		"log-2024-07-01T09:00:00.000Z": "Bought vegetables and fish at the wet market.",
+		"log-2024-07-02T09:00:00.000Z": "Saw the doctor about my knee.",
+		"log-2024-07-03T09:00:00.000Z": "Attended my nephew's wedding dinner in Ipoh.",
+		"log-2024-07-04T09:00:00.000Z": "Played mahjong with the neighbours.",
+		"log-2024-07-05T09:00:00.000Z": "Watered the orchids on the balcony.",
+		"log-2024-07-06T09:00:00.000Z": "Took the bus to the library.",
+		"log-2024-07-07T09:00:00.000Z": "Cooked curry chicken for the grandchildren.",
+	}
+	for bn, s := range entries {
+		logs.Put(ctx, u, bn, logstore.Transcript, []byte(s))
+		logs.Put(ctx, u, bn, logstore.Summary, []byte(s))
+	}
+
+	memgen := func(prompt string) string {
+		f.Reset()
+		w := httptest.NewRecorder()
+		memGenFunc(w, httptest.NewRequest("GET", "/memgen?userID="+u+"&userPrompt="+url.QueryEscape(prompt), nil))
+		c := f.Calls()
+		if len(c) != 1 {
+			t.Fatalf("calls: %d", len(c))
+		}
+		return c[0].Prompt
+	}
+
+	p := memgen("remember the wedding in Ipoh")
+	if !strings.HasPrefix(p, "remember the wedding in Ipoh\nlog-2024-07-03T09:00:00.000Z:\nAttended my nephew's wedding") {
+		t.Errorf("the wedding should be the first entry:\n%s", p)
+	}
+	if n := strings.Count(p, "log-2024-07-"); n != memoryEntryCount {
+		t.Errorf("entries: %d", n)
+	}
+
+	// An entry saved later is indexed on save.
+	const bn = "log-2024-07-08T09:00:00.000Z"
+	logs.Put(ctx, u, bn, logstore.Transcript, []byte("Flew kites at Marina Barrage with my grandson."))
+	logs.Put(ctx, u, bn, logstore.Summary, []byte("Kite flying at Marina Barrage."))
+	indexLogEntry(u, bn)
+	if p := memgen("kite flying at Marina Barrage"); !strings.HasPrefix(p, "kite flying at Marina Barrage\n"+bn+":") {
+		t.Errorf("the new entry should be the first:\n%s", p)
+	}
+
+	// An entry written by another process, eg. a migration, is indexed on the next search.
+	const migrated = "log-2024-07-09T09:00:00.000Z"
+	logs.Put(ctx, u, migrated, logstore.Transcript, []byte("Sang karaoke at the community centre."))
+	logs.Put(ctx, u, migrated, logstore.Summary, []byte("Karaoke at the community centre."))
+	if p := memgen("karaoke at the community centre"); !strings.HasPrefix(p, "karaoke at the community centre\n"+migrated+":") {
+		t.Errorf("the migrated entry should be the first:\n%s", p)
+	}
+
+	if p := memgen(" "); strings.Count(p, "log-2024-07-") != memoryEntryCount {
+		t.Errorf("an empty prompt should select entries at random:\n%s", p)
+	}
+}
+
+func TestLogIndexSync(t *testing.T) {
+	ctx := context.Background()
+	const u = "u-sync"
+	const a, b, c = "log-2024-06-01T09:00:00.000Z", "log-2024-06-02T09:00:00.000Z", "log-2024-06-03T09:00:00.000Z"
+	for _, bn := range []string{a, b, c} {
+		logs.Put(ctx, u, bn, logstore.Transcript, []byte("transcript of "+bn))
+		logs.Put(ctx, u, bn, logstore.Summary, []byte("summary of "+bn))
+	}
+	holds := func(coll *chromem.Collection, want ...string) {
+		t.Helper()
+		for _, bn := range want {
+			if _, err := coll.GetByID(ctx, bn); err != nil {
+				t.Errorf("collection should hold %s", bn)
+			}
+		}
+		if coll.Count() != len(want) {
+			t.Errorf("collection holds %d entries, want %v", coll.Count(), want)
+		}
+	}
+
+	coll, err := logIdx.sync(ctx, u, []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holds(coll, a, b)
+	// b deleted and c added leave the count unchanged
+	coll, _ = logIdx.sync(ctx, u, []string{a, c})
+	holds(coll, a, c)
+	// c deleted while the server was down: a new index over the same database
+	coll, _ = (&logIndex{users: map[string]*userLogIndex{}}).sync(ctx, u, []string{a})
+	holds(coll, a)
+
+	if bn, err := logIdx.search(ctx, "nobody", "wedding", memoryEntryCount); err != nil || len(bn) != 0 {
+		t.Errorf("unknown user: %v %v", bn, err)
+	}
+	if logDB.GetCollection(logCollectionName("nobody"), nil) != nil {
+		t.Error("no collection should be created for an unknown user")
+	}
+	if logDB.GetCollection(logCollectionName(u), nil) == nil || collection.Count() != len(kb.list("")) {
+		t.Error("log entries should be kept in their own database")
+	}
+}
+
+// failingReads is a log store backend whose summaries cannot be read.
+type failingReads struct{ logstore.Backend }
+
+func (b failingReads) Read(ctx context.Context, userID, name string) ([]byte, error) {
+	if strings.HasSuffix(name, ".summary.txt") {
+		return nil, errors.New("disk error")
+	}
+	return b.Backend.Read(ctx, userID, name)
+}
+
+func TestLogExport(t *testing.T) {
+	t.Setenv("LOG_TOKEN", "secret")
+	export := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/export?"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		requireLogToken(logExportFunc)(w, r)
+		return w
+	}
+
+	w := export("userID=123456")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" ||
+		!strings.HasPrefix(w.Header().Get("Content-Disposition"), `attachment; filename="aigogo-123456-`) {
+		t.Fatalf("zip: %d %v", w.Code, w.Header())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	for _, want := range []string{"123456/log-2024-08-04T02:25:10.513Z.summary.txt", "123456/highlights.txt", "123456/manifest.json", "123456/index.html"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("archive should contain %s: %v", want, names)
+		}
+	}
+
+	if w := export("userID=123456&format=tar"); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" {
+		t.Errorf("tar: %d %v", w.Code, w.Header())
+	}
+	if w := export("userID=123456&format=rar"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad format: %d", w.Code)
+	}
+	if w := export("userID=nobody"); w.Code != http.StatusNotFound || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("unknown user: %d %v", w.Code, w.Header())
+	}
+	old := logs
+	t.Cleanup(func() { logs = old })
+	logs = logstore.New(failingReads{old.Backend})
+	if w := export("userID=123456"); w.Code != http.StatusInternalServerError || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("failed export should be an error, not a truncated archive: %d %v", w.Code, w.Header())
+	}
+	logs = old
+
+	w = httptest.NewRecorder()
+	requireLogToken(logExportFunc)(w, httptest.NewRequest("GET", "/export?userID=123456", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("without the token: %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/prompt"
+)
+
+// prompts holds the system instruction and prompt templates.
+var prompts *prompt.Registry
+
+// initPrompts loads the embedded templates, overridden by *.tmpl files in PROMPT_DIR if set.
+func initPrompts() *prompt.Registry {
+	r, err := prompt.Load(os.Getenv("PROMPT_DIR"))
+	if err != nil {
+		log.Fatalf("could not load prompt templates: %v", err)
+	}
+	for _, t := range r.Templates() {
+		log.Printf("prompt template %s from %s", t.ID(), t.Source)
+	}
+	return r
+}
+
+// errPrompt is returned by renderPrompt when a template cannot be rendered.
+// The details are logged.
+var errPrompt = errors.New("the assistant is not available, please try again later")
+
+// renderPrompt renders the named template, or the variant userID is assigned to if
+// it is under experiment. It returns the text and the template ID, which is logged
+// for the generation it is used in, or errPrompt so that the request fails rather
+// than run with an empty prompt.
+func renderPrompt(name, userID string, v prompt.Vars) (string, string, error) {
+	s, id, err := prompts.Render(variantFor(name, userID), v)
+	if err != nil {
+		log.Printf("ERROR: prompt %s: %v", name, err)
+		return "", "", errPrompt
+	}
+	log.Printf("generating with prompt %s", id)
+	return s, id, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimit limits the requests of an endpoint class per userID and per client IP.
+type rateLimit struct {
+	Requests   int    `json:"requests"`   // per Per, 0 disables the limit
+	Per        string `json:"per"`        // eg. "1m"
+	Burst      int    `json:"burst"`      // requests allowed at once, default Requests
+	Concurrent int    `json:"concurrent"` // requests in progress at once, 0 for no limit
+	IPFactor   int    `json:"ipFactor"`   // the limits per IP are this multiple of those per user, default 5
+}
+
+// rateLimits holds the limits of each endpoint class.
+var rateLimits = map[string]rateLimit{
+	"generation":    {Requests: 20, Per: "1m", Burst: 5, Concurrent: 2},
+	"transcription": {Requests: 10, Per: "1m", Burst: 3, Concurrent: 1},
+	"geocoding":     {Requests: 30, Per: "1m", Burst: 10},
+	"export":        {Requests: 5, Per: "1h", Burst: 2, Concurrent: 1},
+}
+
+// limiters holds the limiter of each endpoint class.
+var limiters = map[string]*limiter{}
+
+// loadRateLimits reads the JSON file named by RATE_LIMITS, eg.
+//
+//	{"generation": {"requests": 10, "per": "1m", "burst": 3, "concurrent": 1, "ipFactor": 10}}
+//
+// Classes not in the file keep their default limits.
+func loadRateLimits() {
+	if fn := os.Getenv("RATE_LIMITS"); fn != "" {
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m := map[string]rateLimit{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			log.Fatalf("could not parse %s: %v", fn, err)
+		}
+		for class, rl := range m {
+			rateLimits[class] = rl
+		}
+	}
+	for class, rl := range rateLimits {
+		l, err := newLimiter(rl)
+		if err != nil {
+			log.Fatalf("rate limit %s: %v", class, err)
+		}
+		limiters[class] = l
+	}
+	log.Printf("rate limits: %+v", rateLimits)
+}
+
+// limiter holds a token bucket and an in-progress count per key.
+type limiter struct {
+	cfg    rateLimit
+	every  time.Duration // between requests
+	mu     sync.Mutex
+	keys   map[string]*bucket
+	pruned time.Time
+}
+
+type bucket struct {
+	lim      *rate.Limiter
+	inflight int
+	max      int // in-progress requests, 0 for no limit
+}
+
+func newLimiter(rl rateLimit) (*limiter, error) {
+	l := &limiter{cfg: rl, keys: map[string]*bucket{}}
+	if rl.Requests <= 0 {
+		return l, nil
+	}
+	per, err := time.ParseDuration(rl.Per)
+	if err != nil {
+		return nil, err
+	}
+	if l.cfg.Burst <= 0 {
+		l.cfg.Burst = rl.Requests
+	}
+	if l.cfg.IPFactor <= 0 {
+		l.cfg.IPFactor = 5
+	}
+	l.every = per / time.Duration(rl.Requests)
+	return l, nil
+}
+
+// acquire takes a request from the buckets of userID, if not empty, and ip.
+// It returns a release func to call when the request completes or, if the
+// request is limited, how long the client should wait.
+func (l *limiter) acquire(userID, ip string) (release func(), wait time.Duration) {
+	if l.cfg.Requests <= 0 {
+		return func() {}, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+	bs := []*bucket{l.bucket("ip:"+ip, l.cfg.IPFactor)}
+	if userID != "" {
+		bs = append(bs, l.bucket("user:"+userID, 1))
+	}
+	for _, b := range bs {
+		if b.max > 0 && b.inflight >= b.max {
+			return nil, time.Second
+		}
+	}
+	res := []*rate.Reservation{}
+	for _, b := range bs {
+		r := b.lim.ReserveN(now, 1)
+		res = append(res, r)
+		if d := r.DelayFrom(now); d > 0 {
+			for _, r := range res {
+				r.CancelAt(now)
+			}
+			return nil, d
+		}
+	}
+	for _, b := range bs {
+		b.inflight++
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, b := range bs {
+			b.inflight--
+		}
+	}, 0
+}
+
+// bucket returns the bucket of key, with limits factor times those configured.
+// The caller must hold l.mu.
+func (l *limiter) bucket(key string, factor int) *bucket {
+	b, ok := l.keys[key]
+	if !ok {
+		b = &bucket{
+			lim: rate.NewLimiter(rate.Every(l.every/time.Duration(factor)), l.cfg.Burst*factor),
+			max: l.cfg.Concurrent * factor,
+		}
+		l.keys[key] = b
+	}
+	return b
+}
+
+// prune forgets idle keys with full buckets, at most once a minute.
+// The caller must hold l.mu.
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for k, b := range l.keys {
+		if b.inflight == 0 && b.lim.TokensAt(now) >= float64(b.lim.Burst()) {
+			delete(l.keys, k)
+		}
+	}
+}
+
+// busy returns the number of requests in progress for key.
+func (l *limiter) busy(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.keys[key]; ok {
+		return b.inflight
+	}
+	return 0
+}
+
+// clientIP is the address of the client. With TRUST_PROXY set, it is the last
+// address in X-Forwarded-For, as added by the load balancer.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") != "" {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			s := strings.Split(xff, ",")
+			return strings.TrimSpace(s[len(s)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited limits requests to h by the limits of class.
+func rateLimited(class string, h http.HandlerFunc) http.HandlerFunc {
+	return rateLimitedBy(func(*http.Request) string { return class }, h)
+}
+
+// rateLimitedBy limits requests to h by the limits of the class returned by
+// classOf. Requests of no class, "", are not limited. Limited requests get
+// 429 Too Many Requests with a Retry-After header.
+func rateLimitedBy(classOf func(*http.Request) string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := limiters[classOf(r)]
+		if !ok {
+			h(w, r)
+			return
+		}
+		release, wait := l.acquire(r.FormValue("userID"), clientIP(r))
+		if release == nil {
+			secs := int(math.Ceil(wait.Seconds()))
+			log.Printf("rate limited %s %s userID=%q ip=%s for %ds", classOf(r), r.URL.Path, r.FormValue("userID"), clientIP(r), secs)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, fmt.Sprintf("Too many requests, please try again in %d seconds.", secs), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		h(w, r)
+	}
+}
+
+// dataClass is the class of a /data request: transcription of an audio log or
+// generation of a summary of an edited log.
+func dataClass(r *http.Request) string {
+	switch {
+	case r.FormValue("filename") != "":
+		return "transcription"
+	case r.FormValue("editedlog") != "":
+		return "generation"
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/gen"
+	"github.com/siuyin/dflt"
+)
+
+// timeLayout formats the current time in prompts.
+const timeLayout = "Monday, 15:04PM, 2 January 2006"
+
+// respCache replays /retr and /life responses to identical prompts. nil disables caching.
+var respCache *gen.Cache
+
+// initResponseCache reads RESPONSE_CACHE_TTL (default 1h, 0 disables the cache),
+// RESPONSE_CACHE_ENTRIES (default 500) and RESPONSE_CACHE_BYTES (default 10MB).
+// The cache is disabled by default when TESTING is set.
+func initResponseCache() *gen.Cache {
+	def := "1h"
+	if os.Getenv("TESTING") != "" {
+		def = "0"
+	}
+	ttl, err := time.ParseDuration(dflt.EnvString("RESPONSE_CACHE_TTL", def))
+	if err != nil {
+		log.Fatalf("RESPONSE_CACHE_TTL: %v", err)
+	}
+	if ttl <= 0 {
+		log.Println("response cache disabled")
+		return nil
+	}
+	n, err := strconv.Atoi(dflt.EnvString("RESPONSE_CACHE_ENTRIES", "500"))
+	if err != nil {
+		log.Fatalf("RESPONSE_CACHE_ENTRIES: %v", err)
+	}
+	b, err := strconv.Atoi(dflt.EnvString("RESPONSE_CACHE_BYTES", "10000000"))
+	if err != nil {
+		log.Fatalf("RESPONSE_CACHE_BYTES: %v", err)
+	}
+	return gen.NewCache(ttl, n, b)
+}
+
+// hourly replaces the current time in a rendered prompt with the hour, so that
+// responses are reused for the same prompt within the hour.
+func hourly(text string, now time.Time) string {
+	return strings.Replace(text, now.Format(timeLayout), now.Format("2006-01-02T15 MST"), 1)
+}
+
+// cachedStream returns the cached response for key, or starts a generation that
+// will be cached. Prompts asking for something random are never cached.
+func cachedStream(key, userPrompt string, start func() gen.Iterator) (gen.Iterator, bool) {
+	if respCache == nil || strings.Contains(strings.ToLower(userPrompt), "random") {
+		return start(), false
+	}
+	it, hit := respCache.Stream(key, start)
+	if hit {
+		log.Printf("response cache hit: %s", key[:12])
+	}
+	return it, hit
+}
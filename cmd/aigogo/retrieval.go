@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/philippgille/chromem-go"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/bm25"
+)
+
+// retrievalConfig controls how many documents are retrieved for augmentation.
+type retrievalConfig struct {
+	K             int     // maximum number of documents
+	MinSimilarity float32 // vector results less similar to the query are dropped, 0 keeps all
+	// MinKeywordMatch drops keyword results not found by the vector search
+	// whose bm25 Match is lower, eg. a single shared word in a longer query.
+	// 0 keeps all.
+	MinKeywordMatch float64
+}
+
+// retrievalSettings are the fields of a retrievalConfig set in RETRIEVAL_CONFIG.
+// Fields not set, nil, are taken from the default.
+type retrievalSettings struct {
+	K               *int     `json:"k"`
+	MinSimilarity   *float32 `json:"minSimilarity"`
+	MinKeywordMatch *float64 `json:"minKeywordMatch"`
+}
+
+// apply returns cfg with the fields set in s.
+func (s retrievalSettings) apply(cfg retrievalConfig) retrievalConfig {
+	if s.K != nil {
+		cfg.K = *s.K
+	}
+	if s.MinSimilarity != nil {
+		cfg.MinSimilarity = *s.MinSimilarity
+	}
+	if s.MinKeywordMatch != nil {
+		cfg.MinKeywordMatch = *s.MinKeywordMatch
+	}
+	return cfg
+}
+
+// maxK bounds the number of documents a request may ask for.
+const maxK = 10
+
+// defaultRetrievalConfig is the built-in default configuration.
+var defaultRetrievalConfig = retrievalConfig{K: 2, MinKeywordMatch: 0.4}
+
+// retrievalConfigs holds the settings over the built-in default under
+// "default" and the settings over that default per context.
+var retrievalConfigs = map[string]retrievalSettings{}
+
+// loadRetrievalConfigs reads the JSON file named by RETRIEVAL_CONFIG, eg.
+//
+//	{"default": {"k": 2, "minSimilarity": 0.3, "minKeywordMatch": 0.5}, "Penang": {"k": 5}, "Quiet": {"k": 0}}
+//
+// Fields a context does not set fall back to the default, and fields the
+// default does not set to the built-in default.
+func loadRetrievalConfigs() {
+	fn := os.Getenv("RETRIEVAL_CONFIG")
+	if fn == "" {
+		return
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := map[string]retrievalSettings{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Fatalf("could not parse %s: %v", fn, err)
+	}
+	retrievalConfigs = m
+	for c, s := range m {
+		log.Printf("retrieval config %s: %+v", c, s.apply(m["default"].apply(defaultRetrievalConfig)))
+	}
+}
+
+// retrievalConfigFor returns the configuration for the request's context,
+// overridden by the request's k, minSim and minKw form values.
+func retrievalConfigFor(r *http.Request) retrievalConfig {
+	cfg := retrievalConfigs["default"].apply(defaultRetrievalConfig)
+	cfg = retrievalConfigs[r.FormValue("ctx")].apply(cfg)
+
+	if k, err := strconv.Atoi(r.FormValue("k")); err == nil {
+		cfg.K = k
+	}
+	if s, err := strconv.ParseFloat(r.FormValue("minSim"), 32); err == nil {
+		cfg.MinSimilarity = float32(s)
+	}
+	if m, err := strconv.ParseFloat(r.FormValue("minKw"), 64); err == nil {
+		cfg.MinKeywordMatch = m
+	}
+	cfg.K = max(0, min(cfg.K, maxK))
+	return cfg
+}
+
+// retrieved is a document selected for augmentation with its per-retriever scores.
+type retrieved struct {
+	ID          string
+	Content     string
+	Similarity  float32 // vector cosine similarity
+	VectorRank  int     // 1-based rank from vector search, 0 if not found
+	BM25        float64 // keyword score
+	KeywordRank int     // 1-based rank from keyword search, 0 if not found
+	Score       float64 // reciprocal rank fusion score
+}
+
+// rrfK dampens the influence of top ranks in reciprocal rank fusion.
+const rrfK = 60
+
+// candidates is the number of results taken from each retriever before fusion.
+func candidates(k int) int {
+	return max(4*k, 20)
+}
+
+// fuse merges vector and keyword results with reciprocal rank fusion,
+// scoring each document sum(1/(rrfK+rank)) over the retrievers that found it,
+// and returns the best cfg.K. Keyword results not found by the vector search
+// are skipped if they match the query less than cfg.MinKeywordMatch or are no
+// longer in the knowledge base.
+func fuse(vec []chromem.Result, kw []bm25.Result, cfg retrievalConfig) []retrieved {
+	m := map[string]*retrieved{}
+	for i, v := range vec {
+		m[v.ID] = &retrieved{ID: v.ID, Content: v.Content, Similarity: v.Similarity, VectorRank: i + 1,
+			Score: 1.0 / float64(rrfK+i+1)}
+	}
+	for i, v := range kw {
+		d, ok := m[v.ID]
+		if !ok {
+			if v.Match < cfg.MinKeywordMatch {
+				continue // too little in common with the query
+			}
+			doc, found := kb.get(v.ID)
+			if !found {
+				continue // deleted since the keyword search
+			}
+			d = &retrieved{ID: v.ID, Content: chromemDoc(doc).Content}
+			m[v.ID] = d
+		}
+		d.BM25 = v.Score
+		d.KeywordRank = i + 1
+		d.Score += 1.0 / float64(rrfK+i+1)
+	}
+
+	res := []retrieved{}
+	for _, d := range m {
+		res = append(res, *d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].ID < res[j].ID
+	})
+	if len(res) > cfg.K {
+		res = res[:cfg.K]
+	}
+	return res
+}
+
+// writeRetrievalDebug writes the per-retriever scores of res as a markdown code block.
+func writeRetrievalDebug(w io.Writer, res []retrieved) {
+	fmt.Fprintln(w, "```")
+	fmt.Fprintln(w, "retrieval debug: id, rrf score, vector rank/similarity, keyword rank/bm25, title")
+	for _, d := range res {
+		title, _, _ := strings.Cut(d.Content, " | ")
+		fmt.Fprintf(w, "%s, %.4f, %d/%.3f, %d/%.3f, %s\n", d.ID, d.Score, d.VectorRank, d.Similarity, d.KeywordRank, d.BM25, title)
+	}
+	fmt.Fprint(w, "```\n\n")
+}
+
+// source identifies a retrieved document so that an answer can be audited.
+type source struct {
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	Context    string   `json:"context"`
+	Similarity *float32 `json:"similarity,omitempty"` // absent for keyword-only matches
+	Score      float64  `json:"score"`
+}
+
+// sources lists res in retrieval order with titles from the knowledge base.
+func sources(res []retrieved) []source {
+	s := []source{}
+	for _, d := range res {
+		src := source{ID: d.ID, Score: d.Score}
+		if doc, ok := kb.get(d.ID); ok {
+			src.Title, src.Context = doc.Title, doc.Context
+		} else {
+			src.Title, _, _ = strings.Cut(d.Content, " | ")
+		}
+		if d.VectorRank > 0 {
+			sim := d.Similarity
+			src.Similarity = &sim
+		}
+		s = append(s, src)
+	}
+	return s
+}
+
+// sourcesHeader is the response header carrying the JSON list of sources of a /retr answer.
+// Header values must be ASCII, so other characters are sent as JSON \u escapes.
+const sourcesHeader = "X-Sources"
+
+func setSourcesHeader(w http.ResponseWriter, s []source) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set(sourcesHeader, asciiJSON(string(b)))
+}
+
+// asciiJSON replaces the non-ASCII characters of the JSON text s with \u escapes.
+func asciiJSON(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+			continue
+		}
+		fmt.Fprintf(&b, `\u%04x`, r)
+	}
+	return b.String()
+}
+
+// docFunc returns a cited knowledge-base document as JSON.
+func docFunc(w http.ResponseWriter, r *http.Request) {
+	d, ok := kb.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
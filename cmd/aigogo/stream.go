@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/siuyin/aigogo/cmd/aigogo/internal/gen"
+	"google.golang.org/api/iterator"
+)
+
+// stream writes a generation to the client. By default the text is written as
+// it arrives. Clients that send "Accept: text/event-stream" or stream=sse get
+// server-sent events instead, each with a JSON data line:
+//
+//	response      {"id":..}  identifies the response for feedback
+//	conversation  {"id":..}  when userID is set (/retr)
+//	sources       [{"id":..,"title":..,"context":..,"similarity":..,"score":..}]  (/retr)
+//	debug         {"text":..}  retrieval scores when debug is set (/retr)
+//	token         {"text":..}
+//	safety        {"blocked":..,"blockReason":..,"ratings":[{"category":..,"probability":..,"blocked":..}]}
+//	finish        {"reason":..}
+//	usage         {"promptTokens":..,"candidatesTokens":..,"totalTokens":..}
+//	error         {"message":..}
+//
+// A successful stream ends with finish and usage, a failed one with error.
+// A stream stops without an event when the client goes away.
+type stream struct {
+	w         http.ResponseWriter
+	f         http.Flusher    // nil if w cannot flush
+	ctx       context.Context // of the request
+	sse       bool
+	issue     string // plain text error format, given the error
+	id        string // response ID, also sent in the X-Response-ID header
+	out       strings.Builder
+	failed    bool
+	cancelled bool                 // the client went away
+	cached    bool                 // replayed from the response cache
+	usage     *genai.UsageMetadata // of the last generation
+}
+
+// newStream must be called before anything is written to w.
+func newStream(w http.ResponseWriter, r *http.Request, issue string) *stream {
+	s := &stream{w: w, ctx: r.Context(), sse: wantsSSE(r), issue: issue, id: newResponseID()}
+	s.f, _ = w.(http.Flusher)
+	w.Header().Set("X-Response-ID", s.id)
+	if s.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		s.event("response", responseEvent{s.id})
+	}
+	return s
+}
+
+func newResponseID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("resp-%x", b)
+}
+
+type responseEvent struct {
+	ID string `json:"id"`
+}
+
+func wantsSSE(r *http.Request) bool {
+	return r.FormValue("stream") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func (s *stream) flush() {
+	if s.f != nil {
+		s.f.Flush()
+	}
+}
+
+func (s *stream) event(name string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, b)
+	s.flush()
+}
+
+type textEvent struct {
+	Text string `json:"text"`
+}
+
+func (s *stream) text(t string) {
+	if t == "" {
+		return
+	}
+	s.out.WriteString(t)
+	if s.sse {
+		s.event("token", textEvent{t})
+		return
+	}
+	io.WriteString(s.w, t)
+	s.flush()
+}
+
+type conversationEvent struct {
+	ID string `json:"id"`
+}
+
+// conversation is only sent as an event, plain text clients read the X-Conversation header.
+func (s *stream) conversation(id string) {
+	if s.sse {
+		s.event("conversation", conversationEvent{id})
+	}
+}
+
+// sources is only sent as an event, plain text clients read the X-Sources header.
+func (s *stream) sources(src []source) {
+	if s.sse {
+		s.event("sources", src)
+	}
+}
+
+func (s *stream) debug(res []retrieved) {
+	if !s.sse {
+		writeRetrievalDebug(s.w, res)
+		return
+	}
+	var b strings.Builder
+	writeRetrievalDebug(&b, res)
+	s.event("debug", textEvent{b.String()})
+}
+
+var errUnavailable = errors.New("the model is busy or unavailable, please try again later")
+
+type errorEvent struct {
+	Message string `json:"message"`
+}
+
+// error reports a problem found before generation started.
+func (s *stream) error(msg string) {
+	s.failed = true
+	if s.sse {
+		s.event("error", errorEvent{msg})
+		return
+	}
+	io.WriteString(s.w, msg)
+}
+
+// fail reports a generation error with any safety ratings from err or resp.
+// When no model is available the client is asked to try again later.
+func (s *stream) fail(err error, resp *genai.GenerateContentResponse) {
+	log.Printf("generation error: %v", err)
+	s.failed = true
+	sf := safetyFrom(err, resp)
+	if errors.Is(err, gen.ErrUnavailable) {
+		err = errUnavailable
+	}
+	if s.sse {
+		if sf.Blocked || len(sf.Ratings) > 0 {
+			s.event("safety", sf)
+		}
+		s.event("error", errorEvent{err.Error()})
+		return
+	}
+	fmt.Fprintf(s.w, s.issue, err)
+	for _, sr := range sf.Ratings {
+		fmt.Fprintf(s.w, " category:%v, probability: %v, blocked: %v", sr.Category, sr.Probability, sr.Blocked)
+	}
+}
+
+// gone reports whether the client has gone away, and if so marks s cancelled.
+func (s *stream) gone() bool {
+	if !errors.Is(s.ctx.Err(), context.Canceled) {
+		return false
+	}
+	if !s.cancelled {
+		log.Printf("response %s cancelled by the client after %d bytes", s.id, s.out.Len())
+		s.cancelled = true
+	}
+	return true
+}
+
+// copy streams iter to the client until it ends or the client goes away.
+func (s *stream) copy(iter gen.Iterator) {
+	for {
+		if s.gone() {
+			return
+		}
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			if s.gone() {
+				return
+			}
+			s.fail(err, iter.MergedResponse())
+			return
+		}
+		if resp.UsageMetadata != nil {
+			s.usage = resp.UsageMetadata
+		}
+		s.text(gen.Text(resp))
+	}
+	if !s.sse {
+		return
+	}
+
+	merged := iter.MergedResponse()
+	if sf := safetyFrom(nil, merged); sf.Blocked || len(sf.Ratings) > 0 {
+		s.event("safety", sf)
+	}
+	s.event("finish", finishEvent{finishReason(merged)})
+	if u := s.usage; u != nil {
+		s.event("usage", usageEvent{u.PromptTokenCount, u.CandidatesTokenCount, u.TotalTokenCount})
+	}
+}
+
+type safetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked"`
+}
+
+type safetyEvent struct {
+	Blocked     bool           `json:"blocked"`
+	BlockReason string         `json:"blockReason,omitempty"`
+	Ratings     []safetyRating `json:"ratings"`
+}
+
+// safetyFrom collects the safety ratings of a blocked err, or else of resp.
+func safetyFrom(err error, resp *genai.GenerateContentResponse) safetyEvent {
+	var cands []*genai.Candidate
+	var pf *genai.PromptFeedback
+	var be *genai.BlockedError
+	switch {
+	case errors.As(err, &be):
+		if be.Candidate != nil {
+			cands = []*genai.Candidate{be.Candidate}
+		}
+		pf = be.PromptFeedback
+	case resp != nil:
+		cands, pf = resp.Candidates, resp.PromptFeedback
+	}
+
+	sf := safetyEvent{Ratings: []safetyRating{}}
+	add := func(rs []*genai.SafetyRating) {
+		for _, sr := range rs {
+			sf.Ratings = append(sf.Ratings, safetyRating{
+				Category:    strings.TrimPrefix(sr.Category.String(), "HarmCategory"),
+				Probability: strings.TrimPrefix(sr.Probability.String(), "HarmProbability"),
+				Blocked:     sr.Blocked,
+			})
+			sf.Blocked = sf.Blocked || sr.Blocked
+		}
+	}
+	if pf != nil {
+		add(pf.SafetyRatings)
+		if pf.BlockReason != genai.BlockReasonUnspecified {
+			sf.Blocked = true
+			sf.BlockReason = strings.TrimPrefix(pf.BlockReason.String(), "BlockReason")
+		}
+	}
+	for _, c := range cands {
+		add(c.SafetyRatings)
+		if c.FinishReason == genai.FinishReasonSafety {
+			sf.Blocked = true
+		}
+	}
+	return sf
+}
+
+type finishEvent struct {
+	Reason string `json:"reason"`
+}
+
+func finishReason(resp *genai.GenerateContentResponse) string {
+	fr := genai.FinishReasonUnspecified
+	if resp != nil && len(resp.Candidates) > 0 {
+		fr = resp.Candidates[0].FinishReason
+	}
+	return strings.TrimPrefix(fr.String(), "FinishReason")
+}
+
+type usageEvent struct {
+	PromptTokens     int32 `json:"promptTokens"`
+	CandidatesTokens int32 `json:"candidatesTokens"`
+	TotalTokens      int32 `json:"totalTokens"`
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/siuyin/aigogo/usage"
+)
+
+// usageLog totals the tokens used per day, user, endpoint and model.
+var usageLog, _ = usage.Open("")
+
+// initUsageLog opens USAGE_LOG. Without it usage is totalled in memory only.
+func initUsageLog() *usage.Log {
+	l, err := usage.Open(os.Getenv("USAGE_LOG"))
+	if err != nil {
+		log.Fatalf("could not read usage log: %v", err)
+	}
+	return l
+}
+
+// recordUsage records the tokens of a model call made for r.
+func recordUsage(r *http.Request, endpoint, model string, u *genai.UsageMetadata) {
+	if u == nil {
+		log.Printf("no usage metadata from %s for %s", model, endpoint)
+		return
+	}
+	addUsage(usageRecord(r, endpoint, model, u))
+}
+
+// recordStreamUsage records the tokens of the generation streamed by s.
+// Cancelled streams are recorded, usually without token counts, and
+// replays from the response cache are not recorded.
+func recordStreamUsage(r *http.Request, endpoint, model string, s *stream) {
+	switch {
+	case s.cached:
+	case s.cancelled:
+		rec := usageRecord(r, endpoint, model, s.usage)
+		rec.Cancelled = true
+		addUsage(rec)
+	default:
+		recordUsage(r, endpoint, model, s.usage)
+	}
+}
+
+// usageRecord returns a record of u, which may be nil.
+func usageRecord(r *http.Request, endpoint, model string, u *genai.UsageMetadata) usage.Record {
+	rec := usage.Record{
+		Time:     time.Now(),
+		UserID:   r.FormValue("userID"),
+		Endpoint: endpoint,
+		Model:    model,
+	}
+	if u != nil {
+		rec.PromptTokens = int64(u.PromptTokenCount)
+		rec.CandidatesTokens = int64(u.CandidatesTokenCount)
+		rec.TotalTokens = int64(u.TotalTokenCount)
+	}
+	return rec
+}
+
+func addUsage(rec usage.Record) {
+	if err := usageLog.Add(rec); err != nil {
+		log.Printf("ERROR: could not record usage: %v", err)
+	}
+}
+
+// usageReportFunc returns token totals grouped by the comma separated dimensions
+// in by (day, user, endpoint, model; default "user,day"), filtered by from, to and userID.
+func usageReportFunc(w http.ResponseWriter, r *http.Request) {
+	by := dimensions(r.FormValue("by"))
+	rows, err := usageLog.Report(usage.Filter{From: r.FormValue("from"), To: r.FormValue("to"), UserID: r.FormValue("userID")}, by...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+func dimensions(s string) []string {
+	if s == "" {
+		return []string{"user", "day"}
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,52 @@
+// exportlogs writes a user's personal log, with a manifest and an index.html
+// to browse it offline, to a zip or tar archive.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/siuyin/aigogo/logstore"
+	"github.com/siuyin/dflt"
+)
+
+func main() {
+	store := flag.String("store", dflt.EnvString("LOG_STORE", "fs"), "log store: fs or sqlite")
+	dir := flag.String("dir", dflt.EnvString("LOG_DIR", "/data/aigogo"), "folder of the fs log store")
+	db := flag.String("db", dflt.EnvString("LOG_DB", "/data/aigogo/logs.db"), "database of the sqlite log store")
+	user := flag.String("user", "", "userID to export (required)")
+	format := flag.String("format", "zip", "archive format: "+strings.Join(logstore.Formats, ", "))
+	out := flag.String("o", "", "archive file, default aigogo-<user>.<format>")
+	flag.Parse()
+	if *user == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("aigogo-%s.%s", *user, *format)
+	}
+
+	b, err := logstore.Open(*store, *dir, *db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := logstore.New(b).Export(context.Background(), f, *user, *format); err != nil {
+		f.Close()
+		os.Remove(*out)
+		log.Fatalf("could not export %s: %v", *user, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("exported", *user, "to", *out)
+}
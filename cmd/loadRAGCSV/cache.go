@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// embedCache stores embedding vectors keyed by a hash of the embedding model, title and content,
+// so unchanged rows are not embedded again on re-runs.
+type embedCache struct {
+	fn      string
+	Vectors map[string][]float32
+}
+
+// loadCache reads the cache file fn. A missing file gives an empty cache.
+func loadCache(fn string) (*embedCache, error) {
+	c := &embedCache{fn: fn, Vectors: map[string][]float32{}}
+	f, err := os.Open(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&c.Vectors); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// save writes the cache to a temporary file and renames it, so an interrupted save
+// leaves the previous cache intact.
+func (c *embedCache) save() error {
+	tmp := c.fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(c.Vectors); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.fn)
+}
+
+func cacheKey(model, title, content string) string {
+	h := sha256.New()
+	for _, s := range []string{model, title, content} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
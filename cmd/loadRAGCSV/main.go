@@ -2,101 +2,132 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 
-	"github.com/google/generative-ai-go/genai"
+	"github.com/siuyin/aigogo/embedder"
 	"github.com/siuyin/aigogo/rag"
-	"github.com/siuyin/aigotut/client"
 	"github.com/siuyin/dflt"
 )
 
 const batchSize = 90
 
 func main() {
-	dat := loadRAGCSV()
-	res := embed(batchSize, dat[1:])
-	outputEmbeddingsGOB(dat[1:], res)
-}
+	in := flag.String("in", dflt.EnvString("RAGCSV", "/home/siuyin/Downloads/aigogo data - General.csv"),
+		"input file, or folder of markdown files")
+	format := flag.String("format", "", "input format: csv, jsonl, yaml or md. Default: from the input extension")
+	contexts := flag.String("contexts", "", "comma separated list of known contexts. Default: the contexts of the aigogo user interface")
+	maxLen := flag.Int("maxlen", 8000, "maximum characters of title and content")
+	validateOnly := flag.Bool("validate", false, "print the validation report and exit")
+	flag.Parse()
+
+	docs, err := readDocs(*in, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rep := validate(docs, knownContexts(*contexts), *maxLen)
+	rep.print(os.Stdout, len(docs))
+	if len(rep.errors) > 0 {
+		os.Exit(1)
+	}
+	if *validateOnly {
+		return
+	}
 
-func loadRAGCSV() [][]string {
-	fn := dflt.EnvString("RAGCSV", "/home/siuyin/Downloads/aigogo data - General.csv")
-	f, err := os.Open(fn)
+	em, err := embedder.FromEnv("gemini")
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
 
-	c := csv.NewReader(f)
-	dat, err := c.ReadAll()
+	cache, err := loadCache(dflt.EnvString("EMBED_CACHE", "embeddings.cache.gob"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	return dat
+	res, err := embed(em, cache, batchSize, docs)
+	if err != nil {
+		log.Fatalf("%v\nprogress is saved in %s, re-run to resume", err, cache.fn)
+	}
+	outputEmbeddingsGOB(docs, res, em.Name())
 }
 
-func embed(batchSize int, dat [][]string) []*genai.BatchEmbedContentsResponse {
-	res := []*genai.BatchEmbedContentsResponse{}
-	for i := 0; i < len(dat); i += batchSize {
+// embed returns the embeddings of docs in order. Documents found in cache are not embedded again.
+// The cache is saved after every batch so a failed or interrupted run resumes where it stopped.
+func embed(em embedder.Embedder, cache *embedCache, batchSize int, docs []rag.Doc) ([][]float32, error) {
+	todo := []int{}
+	for i, d := range docs {
+		if _, ok := cache.Vectors[cacheKey(em.Name(), d.Title, d.Content)]; !ok {
+			todo = append(todo, i)
+		}
+	}
+	fmt.Printf("%d documents, %d cached, %d to embed\n", len(docs), len(docs)-len(todo), len(todo))
+
+	for i := 0; i < len(todo); i += batchSize {
 		end := i + batchSize
-		if end > len(dat) {
-			end = len(dat)
+		if end > len(todo) {
+			end = len(todo)
 		}
-		bat := dat[i:end]
-		fmt.Println(len(bat),i,end)
-		r := batchEmbed(bat)
-		res = append(res, r)
+		bat := []rag.Doc{}
+		for _, j := range todo[i:end] {
+			bat = append(bat, docs[j])
+		}
+		fmt.Println(len(bat), i, end)
+		r, err := batchEmbed(em, bat)
+		if err != nil {
+			return nil, fmt.Errorf("embedding documents %d to %d: %v", i, end, err)
+		}
+		for k, d := range bat {
+			cache.Vectors[cacheKey(em.Name(), d.Title, d.Content)] = r[k]
+		}
+		if err := cache.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	res := [][]float32{}
+	for _, d := range docs {
+		res = append(res, cache.Vectors[cacheKey(em.Name(), d.Title, d.Content)])
 	}
-	return res
+	return res, nil
 }
-func batchEmbed(dat [][]string) *genai.BatchEmbedContentsResponse {
-	client.ModelName = "text-embedding-004"
-	cl := client.New()
-	defer cl.Close()
 
+func batchEmbed(em embedder.Embedder, docs []rag.Doc) ([][]float32, error) {
 	ctx := context.Background()
-	em := cl.Client.EmbeddingModel(client.ModelName)
-	b := em.NewBatch()
-	for _, v := range dat {
-		b.AddContentWithTitle(v[1], genai.Text(v[2]))
+	in := []embedder.Input{}
+	for _, d := range docs {
+		in = append(in, embedder.Input{Title: d.Title, Content: d.Content})
 	}
 
-	res, err := em.BatchEmbedContents(ctx, b)
+	res, err := em.EmbedBatch(ctx, in)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return res
-
+	if len(res) != len(in) {
+		return nil, fmt.Errorf("got %d embeddings for %d documents", len(res), len(in))
+	}
+	return res, nil
 }
 
-func outputEmbeddingsGOB(dat [][]string, res []*genai.BatchEmbedContentsResponse) {
-	o, err := os.Create("../aigogo/internal/vecdb/embeddings.gob")
+func outputEmbeddingsGOB(docs []rag.Doc, res [][]float32, model string) {
+	o, err := os.Create(dflt.EnvString("EMBEDDINGS_GOB", "../aigogo/internal/vecdb/embeddings.gob"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer o.Close()
 
 	en := gob.NewEncoder(o)
-	i := 0
-	for _, v := range res {
-		fmt.Println(len(v.Embeddings))
-		for _, w := range v.Embeddings {
-			r := rag.Doc{}
-			r.ID = dat[i][0]
-			r.Title = dat[i][1]
-			r.Content = dat[i][2]
-			r.Context = dat[i][3]
-			r.Embedding = w.Values
-			if os.Getenv("DEBUG") != "" {
-				fmt.Println(r.ID, r.Title, i)
-			}
-			if err := en.Encode(r); err != nil {
-				log.Fatal(err)
-			}
-			i += 1
+	fmt.Println(len(res))
+	for i, v := range res {
+		r := docs[i]
+		r.Embedding = v
+		r.EmbeddingModel = model
+		if os.Getenv("DEBUG") != "" {
+			fmt.Println(r.ID, r.Title, i)
+		}
+		if err := en.Encode(r); err != nil {
+			log.Fatal(err)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/siuyin/aigogo/embedder"
+	"github.com/siuyin/aigogo/rag"
+)
+
+// flakyEmbedder counts embedded inputs and fails batches after the first failAfter batches.
+type flakyEmbedder struct {
+	*embedder.Local
+	failAfter int
+	batches   int
+	inputs    int
+}
+
+func (f *flakyEmbedder) EmbedBatch(ctx context.Context, in []embedder.Input) ([][]float32, error) {
+	if f.failAfter >= 0 && f.batches >= f.failAfter {
+		return nil, errors.New("quota exceeded")
+	}
+	f.batches++
+	f.inputs += len(in)
+	return f.Local.EmbedBatch(ctx, in)
+}
+
+func TestEmbedResume(t *testing.T) {
+	dat := []rag.Doc{}
+	for i := 0; i < 10; i++ {
+		dat = append(dat, rag.Doc{ID: fmt.Sprint(i), Title: fmt.Sprintf("title %d", i), Content: fmt.Sprintf("content %d", i), Context: "General"})
+	}
+	fn := filepath.Join(t.TempDir(), "cache.gob")
+
+	cache, _ := loadCache(fn)
+	em := &flakyEmbedder{Local: embedder.NewLocal(64), failAfter: 2}
+	if _, err := embed(em, cache, 3, dat); err == nil {
+		t.Fatal("third batch should fail")
+	}
+
+	cache, err := loadCache(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cache.Vectors); n != 6 {
+		t.Errorf("cache should hold the 6 rows of the successful batches, has %d", n)
+	}
+
+	em = &flakyEmbedder{Local: embedder.NewLocal(64), failAfter: -1}
+	res, err := embed(em, cache, 3, dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.inputs != 4 {
+		t.Errorf("resumed run embedded %d rows, expected 4", em.inputs)
+	}
+	if len(res) != len(dat) || len(res[9]) != 64 {
+		t.Errorf("unexpected result: %d vectors", len(res))
+	}
+
+	dat[0].Content = "changed content"
+	em = &flakyEmbedder{Local: embedder.NewLocal(64), failAfter: -1}
+	if _, err := embed(em, cache, 3, dat); err != nil || em.inputs != 1 {
+		t.Errorf("only the changed row should be embedded: %d rows, %v", em.inputs, err)
+	}
+}
+
+func TestReaders(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(s), 0640); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	want := rag.Doc{ID: "7", Title: "Lor Bak", Content: "Fried meat rolls.", Context: "Penang"}
+
+	tests := []struct {
+		name   string
+		path   string
+		format string
+	}{
+		{"CSV", write("tips.csv", "ID,Title,Content,Context\n7,Lor Bak,Fried meat rolls.,Penang\n"), ""},
+		{"JSONL", write("tips.jsonl", `{"ID":"7","Title":"Lor Bak","Content":"Fried meat rolls.","Context":"Penang"}`+"\n\n"), ""},
+		{"YAML", write("tips.yml", "- id: \"7\"\n  title: Lor Bak\n  content: Fried meat rolls.\n  context: Penang\n"), ""},
+		{"Markdown", filepath.Dir(write("md/penang/lor-bak.md", "---\nid: 7\ntitle: Lor Bak\ncontext: Penang\n---\nFried meat rolls.\n")), ""},
+		{"Flag", write("tips.txt", `{"ID":"7","Title":"Lor Bak","Content":"Fried meat rolls.","Context":"Penang"}`), "jsonl"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			docs, err := readDocs(tc.path, tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != 1 || !reflect.DeepEqual(docs[0], want) {
+				t.Errorf("got %#v, expected %#v", docs, want)
+			}
+		})
+	}
+
+	t.Run("MarkdownDefaults", func(t *testing.T) {
+		d, err := readMarkdown(write("md2/hiking.md", "# Bukit Timah\nWear good shoes.\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.ID != "hiking" || d.Title != "Bukit Timah" || d.Content != "Wear good shoes." {
+			t.Errorf("unexpected defaults: %#v", d)
+		}
+	})
+}
+
+func TestCSVHeader(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "tips.csv")
+	os.WriteFile(fn, []byte("Context, content ,Source,ID,Title\nPenang,Fried meat rolls.,KitSiew,7,Lor Bak\n"), 0640)
+	docs, err := readCSV(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rag.Doc{ID: "7", Title: "Lor Bak", Content: "Fried meat rolls.", Context: "Penang", Metadata: map[string]string{"source": "KitSiew"}}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0], want) {
+		t.Errorf("got %#v, expected %#v", docs, want)
+	}
+
+	os.WriteFile(fn, []byte("ID,Title,Content\n7,Lor Bak,Fried meat rolls.\n"), 0640)
+	if _, err := readCSV(fn); err == nil {
+		t.Error("missing Context column should be an error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	docs := []rag.Doc{
+		{ID: "1", Title: "ok", Content: "fine", Context: "Penang"},
+		{ID: "1", Title: "dup", Content: "dup", Context: "Penang"},
+		{ID: "2", Title: "blank", Content: "x"},
+		{ID: "3", Title: "unknown", Content: "x", Context: "Mars"},
+		{ID: "4", Title: "", Content: "no title", Context: "Ipoh"},
+		{ID: "5", Title: "long", Content: strings.Repeat("x", 20), Context: "Ipoh"},
+		{ID: "6", Title: "empty", Content: " ", Context: "Ipoh"},
+	}
+	r := validate(docs, knownContexts(""), 10)
+	if len(r.errors) != 5 || len(r.warnings) != 1 {
+		t.Errorf("expected 5 errors and 1 warning: %q %q", r.errors, r.warnings)
+	}
+	for i, want := range []string{"duplicate ID", "empty context", "unknown context", "exceeds maximum", "empty content"} {
+		if !strings.Contains(r.errors[i], want) {
+			t.Errorf("error %d: %q should mention %q", i, r.errors[i], want)
+		}
+	}
+	if r := validate(docs[:1], knownContexts("Ipoh, Penang"), 100); len(r.errors) != 0 {
+		t.Errorf("unexpected errors: %q", r.errors)
+	}
+}
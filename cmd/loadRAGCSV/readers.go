@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/siuyin/aigogo/rag"
+	"gopkg.in/yaml.v3"
+)
+
+// docReader reads rag documents from path.
+type docReader func(path string) ([]rag.Doc, error)
+
+// readers maps input formats to their readers.
+var readers = map[string]docReader{
+	"csv":   readCSV,
+	"jsonl": readJSONL,
+	"yaml":  readYAML,
+	"md":    readMarkdownDir,
+}
+
+// readDocs reads path with the reader for format. If format is empty it is
+// taken from the extension of path, and folders are read as markdown.
+func readDocs(path string, format string) ([]rag.Doc, error) {
+	if format == "" {
+		format = inputFormat(path)
+	}
+	r, ok := readers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown input format: %q", format)
+	}
+	return r(path)
+}
+
+func inputFormat(path string) string {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return "md"
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yml":
+		return "yaml"
+	case ".ndjson":
+		return "jsonl"
+	case ".markdown":
+		return "md"
+	default:
+		return strings.TrimPrefix(ext, ".")
+	}
+}
+
+// readCSV reads columns by header name: ID, Title, Content and Context, in any order and case.
+// Other named columns are stored as document metadata.
+func readCSV(path string) ([]rag.Doc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dat, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(dat) == 0 {
+		return nil, fmt.Errorf("%s: empty file", path)
+	}
+
+	col := map[string]int{}
+	for i, h := range dat[0] {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if _, dup := col[h]; dup {
+			return nil, fmt.Errorf("%s: duplicate column %q", path, h)
+		}
+		col[h] = i
+	}
+	for _, h := range []string{"id", "title", "content", "context"} {
+		if _, ok := col[h]; !ok {
+			return nil, fmt.Errorf("%s: missing column %q in header %q", path, h, dat[0])
+		}
+	}
+
+	docs := []rag.Doc{}
+	for _, v := range dat[1:] {
+		d := rag.Doc{ID: v[col["id"]], Title: v[col["title"]], Content: v[col["content"]], Context: v[col["context"]]}
+		for h, i := range col {
+			switch h {
+			case "id", "title", "content", "context":
+			default:
+				if v[i] == "" {
+					continue
+				}
+				if d.Metadata == nil {
+					d.Metadata = map[string]string{}
+				}
+				d.Metadata[h] = v[i]
+			}
+		}
+		docs = append(docs, d)
+	}
+	return docs, nil
+}
+
+// readJSONL reads one JSON document per line, eg. {"ID":"1","Title":"..","Content":"..","Context":".."}.
+// Blank lines are skipped.
+func readJSONL(path string) ([]rag.Doc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	docs := []rag.Doc{}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var d rag.Doc
+		if err := json.Unmarshal(line, &d); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+		docs = append(docs, d)
+	}
+	return docs, s.Err()
+}
+
+// readYAML reads a YAML list of documents with keys id, title, content and context.
+func readYAML(path string) ([]rag.Doc, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	docs := []rag.Doc{}
+	if err := yaml.Unmarshal(b, &docs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return docs, nil
+}
+
+// readMarkdownDir reads every .md file in dir and its subfolders as one document.
+// See readMarkdown for the file layout.
+func readMarkdownDir(dir string) ([]rag.Doc, error) {
+	files := []string{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".md") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	docs := []rag.Doc{}
+	for _, fn := range files {
+		d, err := readMarkdown(fn)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	return docs, nil
+}
+
+// readMarkdown reads a markdown file with optional YAML front-matter:
+//
+//	---
+//	id: 42
+//	title: Lor Bak
+//	context: Penang
+//	---
+//	Lor bak is ...
+//
+// The body is the content and other front-matter keys are metadata. A missing id defaults to the file name without extension,
+// and a missing title to the first "# " heading, which is then removed from the content.
+func readMarkdown(fn string) (rag.Doc, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return rag.Doc{}, err
+	}
+	body := strings.ReplaceAll(string(b), "\r\n", "\n")
+
+	fm := map[string]any{}
+	if rest, ok := strings.CutPrefix(body, "---\n"); ok {
+		head, tail, found := strings.Cut(rest, "\n---\n")
+		if !found {
+			return rag.Doc{}, fmt.Errorf("%s: unterminated front-matter", fn)
+		}
+		if err := yaml.Unmarshal([]byte(head), &fm); err != nil {
+			return rag.Doc{}, fmt.Errorf("%s: front-matter: %v", fn, err)
+		}
+		body = tail
+	}
+
+	d := rag.Doc{}
+	for k, v := range fm {
+		s := fmt.Sprint(v)
+		switch strings.ToLower(k) {
+		case "id":
+			d.ID = s
+		case "title":
+			d.Title = s
+		case "context":
+			d.Context = s
+		default:
+			if d.Metadata == nil {
+				d.Metadata = map[string]string{}
+			}
+			d.Metadata[k] = s
+		}
+	}
+	if d.ID == "" {
+		d.ID = strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+	}
+	if d.Title == "" {
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		if t, ok := strings.CutPrefix(lines[0], "# "); ok {
+			d.Title = strings.TrimSpace(t)
+			body = strings.Join(lines[1:], "\n")
+		}
+	}
+	d.Content = strings.TrimSpace(body)
+	return d, nil
+}
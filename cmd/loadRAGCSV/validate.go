@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/siuyin/aigogo/rag"
+)
+
+// report lists problems found in documents before they are embedded.
+type report struct {
+	errors   []string
+	warnings []string
+}
+
+func (r *report) errorf(format string, a ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, a...))
+}
+func (r *report) warningf(format string, a ...any) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, a...))
+}
+
+// validate checks docs for empty or duplicate IDs, empty content or context,
+// contexts not in contexts and content longer than maxLen characters.
+func validate(docs []rag.Doc, contexts []string, maxLen int) report {
+	var r report
+	seen := map[string]int{}
+	for i, d := range docs {
+		n := i + 1
+		switch prev, dup := seen[d.ID]; {
+		case d.ID == "":
+			r.errorf("document %d: empty ID", n)
+		case dup:
+			r.errorf("document %d: duplicate ID %q, first used by document %d", n, d.ID, prev)
+		default:
+			seen[d.ID] = n
+		}
+		if strings.TrimSpace(d.Content) == "" {
+			r.errorf("document %d (ID %q): empty content", n, d.ID)
+		}
+		if strings.TrimSpace(d.Context) == "" {
+			r.errorf("document %d (ID %q): empty context", n, d.ID)
+		} else if !slices.Contains(contexts, d.Context) {
+			r.errorf("document %d (ID %q): unknown context %q", n, d.ID, d.Context)
+		}
+		if l := len([]rune(d.Title)) + len([]rune(d.Content)); l > maxLen {
+			r.errorf("document %d (ID %q): %d characters exceeds maximum of %d", n, d.ID, l, maxLen)
+		}
+		if strings.TrimSpace(d.Title) == "" {
+			r.warningf("document %d (ID %q): empty title", n, d.ID)
+		}
+	}
+	return r
+}
+
+func (r report) print(w io.Writer, n int) {
+	fmt.Fprintf(w, "validation report: %d documents, %d errors, %d warnings\n", n, len(r.errors), len(r.warnings))
+	for _, e := range r.errors {
+		fmt.Fprintln(w, "ERROR:", e)
+	}
+	for _, e := range r.warnings {
+		fmt.Fprintln(w, "WARNING:", e)
+	}
+}
+
+// knownContexts returns rag.Contexts, or the comma separated list s if s is not empty.
+func knownContexts(s string) []string {
+	if s == "" {
+		return rag.Contexts
+	}
+	c := []string{}
+	for _, v := range strings.Split(s, ",") {
+		c = append(c, strings.TrimSpace(v))
+	}
+	return c
+}
@@ -0,0 +1,61 @@
+// migratelogs moves the "---" metadata trailers of existing personal log
+// transcripts into the metadata files that aigogo now writes beside them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/siuyin/aigogo/logstore"
+	"github.com/siuyin/dflt"
+)
+
+func main() {
+	store := flag.String("store", dflt.EnvString("LOG_STORE", "fs"), "log store: fs or sqlite")
+	dir := flag.String("dir", dflt.EnvString("LOG_DIR", "/data/aigogo"), "folder of the fs log store")
+	db := flag.String("db", dflt.EnvString("LOG_DB", "/data/aigogo/logs.db"), "database of the sqlite log store")
+	user := flag.String("user", "", "only this userID")
+	dryRun := flag.Bool("n", false, "list the entries that would be migrated without changing them")
+	flag.Parse()
+
+	b, err := logstore.Open(*store, *dir, *db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+
+	users := []string{*user}
+	if *user == "" {
+		if users, err = b.Users(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := migrate(context.Background(), os.Stdout, logstore.New(b), users, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrate migrates the log entries of users, printing each entry migrated and a total.
+func migrate(ctx context.Context, w io.Writer, s *logstore.Store, users []string, dryRun bool) error {
+	n := 0
+	for _, u := range users {
+		done, err := s.Migrate(ctx, u, dryRun)
+		for _, bn := range done {
+			fmt.Fprintf(w, "%s/%s\n", u, bn)
+		}
+		n += len(done)
+		if err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+	}
+	verb := "migrated"
+	if dryRun {
+		verb = "would migrate"
+	}
+	fmt.Fprintf(w, "%s %d entries\n", verb, n)
+	return nil
+}
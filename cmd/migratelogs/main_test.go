@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/siuyin/aigogo/logstore"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	s := logstore.New(logstore.NewMemory())
+	const bn = "log-2024-08-04T02:25:10.513Z"
+	s.Put(ctx, "u1", bn, logstore.Transcript, []byte("Market.\n---\nlatlng:1.35,103.76, neighborhood:Clementi, primaryHighlight:, secondaryHighlight:, people:"))
+
+	var b strings.Builder
+	if err := migrate(ctx, &b, s, []string{"u1", "u2"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "u1/"+bn+"\nwould migrate 1 entries\n" {
+		t.Errorf("dry run: %q", b.String())
+	}
+
+	b.Reset()
+	migrate(ctx, &b, s, []string{"u1"}, false)
+	if m, err := s.GetMeta(ctx, "u1", bn); err != nil || m.Neighborhood != "Clementi" {
+		t.Errorf("meta: %+v %v", m, err)
+	}
+	if !strings.HasSuffix(b.String(), "migrated 1 entries\n") {
+		t.Errorf("output: %q", b.String())
+	}
+}
@@ -0,0 +1,77 @@
+// usagereport prints the token totals recorded in the aigogo usage log.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/siuyin/aigogo/usage"
+	"github.com/siuyin/dflt"
+)
+
+func main() {
+	fn := flag.String("log", dflt.EnvString("USAGE_LOG", "usage.jsonl"), "usage log written by aigogo")
+	by := flag.String("by", "user,day", "comma separated dimensions to group by: "+strings.Join(usage.Dimensions, ", "))
+	from := flag.String("from", "", "first day, eg. 2024-08-01")
+	to := flag.String("to", "", "last day")
+	user := flag.String("user", "", "only this userID")
+	flag.Parse()
+
+	f, err := os.Open(*fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := usage.Read(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dims := strings.Split(*by, ",")
+	rows, err := usage.Report(recs, usage.Filter{From: *from, To: *to, UserID: *user}, dims...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printReport(os.Stdout, dims, rows)
+}
+
+// printReport writes rows as a table with a grand total.
+func printReport(w io.Writer, dims []string, rows []usage.Row) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\trequests\tprompt\tcandidates\ttotal\tcancelled\t\n", strings.Join(dims, "\t"))
+
+	var total usage.Totals
+	for _, r := range rows {
+		cols := []string{}
+		for _, d := range dims {
+			cols = append(cols, column(r.Key, d))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t\n", strings.Join(cols, "\t"), r.Requests, r.PromptTokens, r.CandidatesTokens, r.TotalTokens, r.Cancelled)
+		total.Requests += r.Requests
+		total.PromptTokens += r.PromptTokens
+		total.CandidatesTokens += r.CandidatesTokens
+		total.TotalTokens += r.TotalTokens
+		total.Cancelled += r.Cancelled
+	}
+	fmt.Fprintf(tw, "total%s\t%d\t%d\t%d\t%d\t%d\t\n", strings.Repeat("\t", len(dims)-1), total.Requests, total.PromptTokens, total.CandidatesTokens, total.TotalTokens, total.Cancelled)
+	tw.Flush()
+}
+
+func column(k usage.Key, dim string) string {
+	switch dim {
+	case "day":
+		return k.Day
+	case "user":
+		return k.UserID
+	case "endpoint":
+		return k.Endpoint
+	case "model":
+		return k.Model
+	}
+	return ""
+}
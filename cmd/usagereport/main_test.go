@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/siuyin/aigogo/usage"
+)
+
+func TestPrintReport(t *testing.T) {
+	rows := []usage.Row{
+		{Key: usage.Key{Day: "2024-08-04", UserID: "u1"}, Totals: usage.Totals{Requests: 2, PromptTokens: 30, CandidatesTokens: 10, TotalTokens: 40}},
+		{Key: usage.Key{Day: "2024-08-05", UserID: "u2"}, Totals: usage.Totals{Requests: 1, PromptTokens: 3, CandidatesTokens: 3, TotalTokens: 6, Cancelled: 1}},
+	}
+	var b strings.Builder
+	printReport(&b, []string{"user", "day"}, rows)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got:\n%s", b.String())
+	}
+	if f := strings.Fields(lines[1]); strings.Join(f, " ") != "u1 2024-08-04 2 30 10 40 0" {
+		t.Errorf("row: %q", lines[1])
+	}
+	if f := strings.Fields(lines[3]); strings.Join(f, " ") != "total 3 33 13 46 1" {
+		t.Errorf("total: %q", lines[3])
+	}
+}
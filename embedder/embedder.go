@@ -0,0 +1,44 @@
+// Package embedder provides text embedding backends shared by aigogo and loadRAGCSV.
+package embedder
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/siuyin/aigotut/client"
+	"github.com/siuyin/dflt"
+)
+
+// Embedder converts text to embedding vectors.
+type Embedder interface {
+	// Name identifies the embedding model. Vectors from differently named embedders are not comparable.
+	Name() string
+	Embed(ctx context.Context, text string) ([]float32, error)
+	EmbedBatch(ctx context.Context, in []Input) ([][]float32, error)
+}
+
+// Input is a document to be embedded by EmbedBatch.
+type Input struct {
+	Title   string
+	Content string
+}
+
+// GeminiModelName is the Gemini embedding model. It is also the model of
+// embeddings recorded before rag.Doc carried an EmbeddingModel.
+const GeminiModelName = "text-embedding-004"
+
+// FromEnv returns the embedder selected by the EMBEDDER environment variable: "gemini" or "local".
+// backend is used when EMBEDDER is not set.
+func FromEnv(backend string) (Embedder, error) {
+	switch dflt.EnvString("EMBEDDER", backend) {
+	case "gemini":
+		client.ModelName = GeminiModelName
+		cl := client.New()
+		return NewGemini(cl.Client, GeminiModelName), nil
+	case "local":
+		return NewLocal(LocalDims), nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDER: %s", os.Getenv("EMBEDDER"))
+	}
+}
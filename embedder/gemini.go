@@ -0,0 +1,49 @@
+package embedder
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Gemini embeds text with a Gemini embedding model.
+type Gemini struct {
+	name  string
+	model *genai.EmbeddingModel
+}
+
+// NewGemini returns an embedder using the named model of cl.
+func NewGemini(cl *genai.Client, name string) *Gemini {
+	return &Gemini{name: name, model: cl.EmbeddingModel(name)}
+}
+
+// Name returns the model name.
+func (g *Gemini) Name() string { return g.name }
+
+// Embed embeds a single text.
+func (g *Gemini) Embed(ctx context.Context, text string) ([]float32, error) {
+	res, err := g.model.EmbedContent(ctx, genai.Text(text))
+	if err != nil {
+		return nil, err
+	}
+	return res.Embedding.Values, nil
+}
+
+// EmbedBatch embeds in with a single batch request.
+// The API limits the batch size, callers should keep batches below 100 inputs.
+func (g *Gemini) EmbedBatch(ctx context.Context, in []Input) ([][]float32, error) {
+	b := g.model.NewBatch()
+	for _, v := range in {
+		b.AddContentWithTitle(v.Title, genai.Text(v.Content))
+	}
+
+	res, err := g.model.BatchEmbedContents(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]float32, 0, len(res.Embeddings))
+	for _, e := range res.Embeddings {
+		out = append(out, e.Values)
+	}
+	return out, nil
+}
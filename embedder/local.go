@@ -0,0 +1,98 @@
+package embedder
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// LocalDims is the default vector size of the local embedder.
+const LocalDims = 512
+
+// Local is an offline, deterministic embedder. Word unigrams, word bigrams
+// and character trigrams are hashed into a fixed size vector with
+// sublinear term frequency weighting. It needs no network access and is
+// intended for development and tests.
+type Local struct {
+	dims int
+}
+
+// NewLocal returns a local embedder producing vectors of size dims.
+func NewLocal(dims int) *Local {
+	return &Local{dims: dims}
+}
+
+// Name returns the embedder name, including its vector size.
+func (l *Local) Name() string { return fmt.Sprintf("local-hash-ngram-%d", l.dims) }
+
+// Embed embeds a single text.
+func (l *Local) Embed(ctx context.Context, text string) ([]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.vector(text), nil
+}
+
+// EmbedBatch embeds each input's title and content together.
+func (l *Local) EmbedBatch(ctx context.Context, in []Input) ([][]float32, error) {
+	out := make([][]float32, 0, len(in))
+	for _, v := range in {
+		e, err := l.Embed(ctx, v.Title+" | "+v.Content)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (l *Local) vector(text string) []float32 {
+	tf := map[string]float64{}
+	words := Tokens(text)
+	for i, w := range words {
+		tf["w:"+w]++
+		if i > 0 {
+			tf["b:"+words[i-1]+" "+w]++
+		}
+		p := []rune("^" + w + "$")
+		for j := 0; j+3 <= len(p); j++ {
+			tf["c:"+string(p[j:j+3])] += 0.5
+		}
+	}
+
+	v := make([]float64, l.dims)
+	for term, n := range tf {
+		h := fnv.New64a()
+		h.Write([]byte(term))
+		sum := h.Sum64()
+		sign := 1.0
+		if sum>>63 == 1 {
+			sign = -1.0
+		}
+		v[sum%uint64(l.dims)] += sign * (1 + math.Log(n))
+	}
+
+	norm := 0.0
+	for _, x := range v {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+	out := make([]float32, l.dims)
+	if norm == 0 {
+		return out
+	}
+	for i, x := range v {
+		out[i] = float32(x / norm)
+	}
+	return out
+}
+
+// Tokens splits text into lower case words of letters and digits.
+func Tokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,39 @@
+package embedder
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	l := NewLocal(LocalDims)
+	ctx := context.Background()
+
+	a, _ := l.Embed(ctx, "Songs about lambs or sheep")
+	b, _ := l.Embed(ctx, "Songs about lambs or sheep")
+	if len(a) != LocalDims {
+		t.Fatalf("vector size: %d, expected %d", len(a), LocalDims)
+	}
+	if dot(a, b) < 0.999 {
+		t.Errorf("identical texts should have identical vectors")
+	}
+
+	near, _ := l.Embed(ctx, "sheep songs")
+	far, _ := l.Embed(ctx, "Restaurants near Petaling Jaya")
+	if dot(a, near) <= dot(a, far) {
+		t.Errorf("similarity to related text: %v should exceed unrelated text: %v", dot(a, near), dot(a, far))
+	}
+
+	v, err := l.EmbedBatch(ctx, []Input{{Title: "t1", Content: "c1"}, {Title: "t2", Content: "c2"}})
+	if err != nil || len(v) != 2 {
+		t.Errorf("batch: %v, %v", len(v), err)
+	}
+}
+
+func dot(a, b []float32) float32 {
+	s := float32(0)
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
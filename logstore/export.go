@@ -0,0 +1,225 @@
+package logstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats are the archive formats of Export.
+var Formats = []string{"zip", "tar"}
+
+// Manifest describes an export archive. It is stored in the archive as manifest.json.
+type Manifest struct {
+	Version  int             `json:"version"`
+	UserID   string          `json:"userID"`
+	Exported time.Time       `json:"exported"`
+	Files    []ManifestFile  `json:"files"`   // the user's files, in the archive under UserID/
+	Entries  []ManifestEntry `json:"entries"` // newest first
+}
+
+// ManifestFile is a file in an export archive.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestEntry is a log entry in an export archive.
+type ManifestEntry struct {
+	Basename   string    `json:"basename"`
+	Time       time.Time `json:"time"`
+	Audio      string    `json:"audio,omitempty"` // file names
+	Transcript string    `json:"transcript,omitempty"`
+	Summary    string    `json:"summary,omitempty"`
+	Meta       *Meta     `json:"meta,omitempty"`
+}
+
+// entryBasename returns the basename of the log entry that file name is part of.
+func entryBasename(name string) (string, bool) {
+	if !strings.HasPrefix(name, "log-") {
+		return "", false
+	}
+	for _, suffix := range []string{"." + string(Summary), MetaFile(""), "." + string(Transcript), "." + string(Audio)} {
+		if bn, ok := strings.CutSuffix(name, suffix); ok {
+			return bn, true
+		}
+	}
+	return "", false
+}
+
+// archiveWriter writes files to a zip or tar archive.
+type archiveWriter interface {
+	add(name string, b []byte, mod time.Time) error
+	Close() error
+}
+
+type zipWriter struct{ *zip.Writer }
+
+func (z zipWriter) add(name string, b []byte, mod time.Time) error {
+	f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mod})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+type tarWriter struct{ *tar.Writer }
+
+func (t tarWriter) add(name string, b []byte, mod time.Time) error {
+	if err := t.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: mod, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := t.Write(b)
+	return err
+}
+
+// Export writes every file of userID to w as a zip or tar archive, under a
+// folder named by userID, with a manifest.json and an index.html to browse
+// the entries offline. It returns ErrNotFound, having written nothing, if
+// userID has no files.
+func (s *Store) Export(ctx context.Context, w io.Writer, userID, format string) error {
+	if err := check(userID, "-"); err != nil {
+		return err
+	}
+	names, err := s.List(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = zipWriter{zip.NewWriter(w)}
+	case "tar":
+		aw = tarWriter{tar.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format %q, want one of %s", format, strings.Join(Formats, ", "))
+	}
+
+	m := Manifest{Version: 1, UserID: userID, Exported: time.Now().UTC(), Files: []ManifestFile{}}
+	entries := map[string]*ManifestEntry{}
+	for _, n := range names {
+		b, err := s.Read(ctx, userID, n)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		m.Files = append(m.Files, ManifestFile{Name: n, Size: len(b), SHA256: hex.EncodeToString(sum[:])})
+
+		mod := m.Exported
+		if bn, ok := entryBasename(n); ok {
+			e := entries[bn]
+			if e == nil {
+				e = &ManifestEntry{Basename: bn}
+				e.Time, _ = EntryTime(bn)
+				entries[bn] = e
+			}
+			if !e.Time.IsZero() {
+				mod = e.Time
+			}
+			switch n {
+			case bn + "." + string(Audio):
+				e.Audio = n
+			case bn + "." + string(Transcript):
+				e.Transcript = n
+			case bn + "." + string(Summary):
+				e.Summary = n
+			case MetaFile(bn):
+				var meta Meta
+				if err := json.Unmarshal(b, &meta); err == nil {
+					e.Meta = &meta
+				}
+			}
+		}
+		if err := aw.add(userID+"/"+n, b, mod); err != nil {
+			return err
+		}
+	}
+	m.Entries = []ManifestEntry{}
+	for _, e := range entries {
+		m.Entries = append(m.Entries, *e)
+	}
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Basename > m.Entries[j].Basename })
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := aw.add(userID+"/manifest.json", b, m.Exported); err != nil {
+		return err
+	}
+	b, err = s.exportIndex(ctx, m)
+	if err != nil {
+		return err
+	}
+	if err := aw.add(userID+"/index.html", b, m.Exported); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+//go:embed export.html
+var exportHTML string
+
+var exportTmpl = template.Must(template.New("export").Parse(exportHTML))
+
+// indexEntry is a log entry shown in index.html.
+type indexEntry struct {
+	ManifestEntry
+	SummaryText, TranscriptText string
+}
+
+// exportIndex renders index.html for the export described by m.
+func (s *Store) exportIndex(ctx context.Context, m Manifest) ([]byte, error) {
+	d := struct {
+		Manifest
+		Entries    []indexEntry
+		Highlights []string
+		Names      string
+	}{Manifest: m, Entries: []indexEntry{}}
+	var err error
+	if d.Highlights, err = s.Highlights(ctx, m.UserID); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if d.Names, err = s.Names(ctx, m.UserID); err != nil {
+		return nil, err
+	}
+	text := func(name string) (string, error) {
+		if name == "" {
+			return "", nil
+		}
+		b, err := s.Read(ctx, m.UserID, name)
+		return string(b), err
+	}
+	for _, e := range m.Entries {
+		ie := indexEntry{ManifestEntry: e}
+		if ie.SummaryText, err = text(e.Summary); err != nil {
+			return nil, err
+		}
+		if ie.TranscriptText, err = text(e.Transcript); err != nil {
+			return nil, err
+		}
+		d.Entries = append(d.Entries, ie)
+	}
+	var b strings.Builder
+	if err := exportTmpl.Execute(&b, d); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,84 @@
+package logstore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FS keeps each user's files in a folder named by the user ID under Dir,
+// eg. /data/aigogo/123456/log-2024-08-04T02:25:10.513Z.txt.
+type FS struct {
+	Dir string
+}
+
+// NewFS returns a backend keeping files under dir, which is created if needed.
+func NewFS(dir string) (*FS, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &FS{Dir: dir}, nil
+}
+
+func (f *FS) Read(ctx context.Context, userID, name string) ([]byte, error) {
+	if err := check(userID, name); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(f.Dir, userID, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (f *FS) Write(ctx context.Context, userID, name string, b []byte) error {
+	if err := check(userID, name); err != nil {
+		return err
+	}
+	dir := filepath.Join(f.Dir, userID)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), b, 0640)
+}
+
+func (f *FS) List(ctx context.Context, userID string) ([]string, error) {
+	if err := check(userID, "-"); err != nil {
+		return nil, err
+	}
+	de, err := os.ReadDir(filepath.Join(f.Dir, userID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range de {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FS) Users(ctx context.Context) ([]string, error) {
+	de, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	for _, e := range de {
+		if e.IsDir() {
+			users = append(users, e.Name())
+		}
+	}
+	return users, nil
+}
+
+// Close is a no-op.
+func (f *FS) Close() error { return nil }
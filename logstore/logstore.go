@@ -0,0 +1,139 @@
+// Package logstore stores users' personal logs: the audio, transcript and
+// summary of each log entry, and each user's custom highlights and names.
+//
+// Every item is a named file of a user. An entry's files share its basename,
+// eg. log-2024-08-04T02:25:10.513Z, and are told apart by their Kind.
+package logstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned when a file does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Kind is a part of a log entry, named by its file extension.
+type Kind string
+
+const (
+	Audio      Kind = "ogg"
+	Transcript Kind = "txt"
+	Summary    Kind = "summary.txt"
+)
+
+// User files other than entries.
+const (
+	HighlightsFile = "highlights.txt" // highlight choices, one per line
+	NamesFile      = "names.txt"      // names to help transcription
+)
+
+// Backend stores the files of each user.
+type Backend interface {
+	// Read returns the named file of userID, or ErrNotFound.
+	Read(ctx context.Context, userID, name string) ([]byte, error)
+	// Write creates or replaces the named file of userID.
+	Write(ctx context.Context, userID, name string, b []byte) error
+	// List returns the names of the files of userID.
+	List(ctx context.Context, userID string) ([]string, error)
+	// Users returns the IDs of the users with files.
+	Users(ctx context.Context) ([]string, error)
+	Close() error
+}
+
+// Open returns the backend of kind "fs", keeping files under dir,
+// "sqlite", keeping them in the database file db, or "memory".
+func Open(kind, dir, db string) (Backend, error) {
+	switch kind {
+	case "fs":
+		return NewFS(dir)
+	case "sqlite":
+		return OpenSQLite(db)
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown log store: %s", kind)
+}
+
+// Store gives typed access to the files of a Backend.
+type Store struct {
+	Backend
+}
+
+// New returns a Store using b.
+func New(b Backend) *Store {
+	return &Store{b}
+}
+
+// check rejects user IDs and names that could escape a user's files.
+func check(userID, name string) error {
+	for _, s := range []string{userID, name} {
+		if s == "" || s == "." || s == ".." || strings.ContainsAny(s, `/\`) {
+			return fmt.Errorf("invalid user ID or file name: %q", s)
+		}
+	}
+	return nil
+}
+
+// Entries returns the basenames of the entries of userID that have a summary,
+// oldest first as basenames start with the time of the entry.
+func (s *Store) Entries(ctx context.Context, userID string) ([]string, error) {
+	names, err := s.List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	suffix := "." + string(Summary)
+	bn := []string{}
+	for _, n := range names {
+		if strings.HasSuffix(n, suffix) {
+			bn = append(bn, strings.TrimSuffix(n, suffix))
+		}
+	}
+	sort.Strings(bn)
+	return bn, nil
+}
+
+// Get returns part k of the entry basename of userID.
+func (s *Store) Get(ctx context.Context, userID, basename string, k Kind) ([]byte, error) {
+	return s.Read(ctx, userID, basename+"."+string(k))
+}
+
+// Put stores part k of the entry basename of userID.
+func (s *Store) Put(ctx context.Context, userID, basename string, k Kind, b []byte) error {
+	return s.Write(ctx, userID, basename+"."+string(k), b)
+}
+
+// Highlights returns the highlight choices of userID.
+func (s *Store) Highlights(ctx context.Context, userID string) ([]string, error) {
+	b, err := s.Read(ctx, userID, HighlightsFile)
+	if err != nil {
+		return nil, err
+	}
+	h := strings.Split(string(b), "\n")
+	if h[len(h)-1] == "" {
+		h = h[:len(h)-1]
+	}
+	return h, nil
+}
+
+// SetHighlights replaces the highlight choices of userID.
+func (s *Store) SetHighlights(ctx context.Context, userID string, h []string) error {
+	return s.Write(ctx, userID, HighlightsFile, []byte(strings.Join(h, "\n")+"\n"))
+}
+
+// Names returns the custom names of userID, or "" if there are none.
+func (s *Store) Names(ctx context.Context, userID string) (string, error) {
+	b, err := s.Read(ctx, userID, NamesFile)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+// SetNames replaces the custom names of userID.
+func (s *Store) SetNames(ctx context.Context, userID, names string) error {
+	return s.Write(ctx, userID, NamesFile, []byte(names))
+}
@@ -0,0 +1,243 @@
+package logstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackends(t *testing.T) {
+	fsb, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "logs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for name, b := range map[string]Backend{"fs": fsb, "memory": NewMemory(), "sqlite": db} {
+		t.Run(name, func(t *testing.T) { testStore(t, New(b)) })
+	}
+}
+
+func testStore(t *testing.T, s *Store) {
+	ctx := context.Background()
+	if e, err := s.Entries(ctx, "u1"); err != nil || len(e) != 0 {
+		t.Errorf("new user should have no entries: %v %v", e, err)
+	}
+	for _, bn := range []string{"log-2024-08-05T01:00:00.000Z", "log-2024-08-04T02:25:10.513Z"} {
+		for k, body := range map[Kind]string{Audio: "ogg data", Transcript: "I went to the market.", Summary: "Market trip."} {
+			if err := s.Put(ctx, "u1", bn, k, []byte(body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.Put(ctx, "u1", "log-2024-08-06T00:00:00.000Z", Audio, []byte("not yet summarized"))
+	s.Put(ctx, "u2", "log-2024-08-07T00:00:00.000Z", Summary, []byte("other user"))
+
+	e, err := s.Entries(ctx, "u1")
+	if err != nil || strings.Join(e, ",") != "log-2024-08-04T02:25:10.513Z,log-2024-08-05T01:00:00.000Z" {
+		t.Errorf("entries: %v %v", e, err)
+	}
+	if b, err := s.Get(ctx, "u1", e[0], Transcript); err != nil || string(b) != "I went to the market." {
+		t.Errorf("transcript: %q %v", b, err)
+	}
+	s.Put(ctx, "u1", e[0], Summary, []byte("Edited."))
+	if b, _ := s.Get(ctx, "u1", e[0], Summary); string(b) != "Edited." {
+		t.Errorf("put should replace: %q", b)
+	}
+	if _, err := s.Get(ctx, "u1", "log-missing", Summary); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing entry: %v", err)
+	}
+
+	if err := s.SetHighlights(ctx, "u1", []string{"Place", " home", "Occasion:happy"}); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := s.Highlights(ctx, "u1"); err != nil || strings.Join(h, "|") != "Place| home|Occasion:happy" {
+		t.Errorf("highlights: %q %v", h, err)
+	}
+	if n, err := s.Names(ctx, "u1"); err != nil || n != "" {
+		t.Errorf("no names: %q %v", n, err)
+	}
+	s.SetNames(ctx, "u1", "Kit Siew\n")
+	if n, _ := s.Names(ctx, "u1"); n != "Kit Siew\n" {
+		t.Errorf("names: %q", n)
+	}
+
+	if u, err := s.Users(ctx); err != nil || strings.Join(u, ",") != "u1,u2" {
+		t.Errorf("users: %v %v", u, err)
+	}
+
+	for _, bad := range [][2]string{{"..", "x"}, {"u1", "../u2/x"}, {"", "x"}, {"u1", ""}} {
+		if err := s.Write(ctx, bad[0], bad[1], nil); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestParseTrailer(t *testing.T) {
+	body, m, ok := ParseTrailer("I went shopping.\n---\nlatlng:1.35,103.76, neighborhood:Bukit Timah, Singapore, primaryHighlight:Place: market, secondaryHighlight:, people:Ah Hock, Mei Ling")
+	if !ok || body != "I went shopping." {
+		t.Fatalf("body: %q %v", body, ok)
+	}
+	if m.Location == nil || *m.Location != (LatLng{1.35, 103.76}) {
+		t.Errorf("location: %v", m.Location)
+	}
+	if m.Neighborhood != "Bukit Timah, Singapore" || m.PrimaryHighlight != "Place: market" || m.SecondaryHighlight != "" {
+		t.Errorf("meta: %+v", m)
+	}
+	if strings.Join(m.People, "|") != "Ah Hock|Mei Ling" {
+		t.Errorf("people: %q", m.People)
+	}
+	if got := m.String(); got != "Where: Bukit Timah, Singapore. Highlights: Place: market. With: Ah Hock, Mei Ling." {
+		t.Errorf("string: %q", got)
+	}
+
+	for _, s := range []string{"no trailer", "a\n---\nb", "a\n---\nlatlng:, people:x"} {
+		if b, _, ok := ParseTrailer(s); ok || b != s {
+			t.Errorf("%q should have no trailer", s)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	s := New(NewMemory())
+	old := "log-2024-08-04T02:25:10.513Z"
+	s.Put(ctx, "u1", old, Audio, []byte("ogg data"))
+	s.Put(ctx, "u1", old, Transcript, []byte("I went shopping.\n---\nlatlng:, neighborhood:Clementi, primaryHighlight:Shopping, secondaryHighlight:, people:"))
+	s.Put(ctx, "u1", old, Summary, []byte("Shopping.\n---\nlatlng:, neighborhood:Clementi, primaryHighlight:Shopping, secondaryHighlight:, people:"))
+	s.Put(ctx, "u1", "log-2024-08-05T00:00:00.000Z", Transcript, []byte("No trailer."))
+	s.SetNames(ctx, "u1", "Kit Siew\n")
+
+	if done, err := s.Migrate(ctx, "u1", true); err != nil || strings.Join(done, ",") != old {
+		t.Fatalf("dry run: %v %v", done, err)
+	}
+	if _, err := s.GetMeta(ctx, "u1", old); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("dry run should not write: %v", err)
+	}
+
+	if done, err := s.Migrate(ctx, "u1", false); err != nil || strings.Join(done, ",") != old {
+		t.Fatalf("migrate: %v %v", done, err)
+	}
+	m, err := s.GetMeta(ctx, "u1", old)
+	if err != nil || m.Neighborhood != "Clementi" || m.PrimaryHighlight != "Shopping" || m.Source != "audio" || m.Location != nil {
+		t.Errorf("meta: %+v %v", m, err)
+	}
+	if tm, _ := EntryTime(old); !m.Created.Equal(tm) {
+		t.Errorf("created: %v", m.Created)
+	}
+	if b, _ := s.Get(ctx, "u1", old, Transcript); string(b) != "I went shopping." {
+		t.Errorf("transcript: %q", b)
+	}
+	if b, _ := s.Get(ctx, "u1", old, Summary); string(b) != "Shopping." {
+		t.Errorf("summary: %q", b)
+	}
+	if done, _ := s.Migrate(ctx, "u1", false); len(done) != 0 {
+		t.Errorf("second run should do nothing: %v", done)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	s := New(NewMemory())
+	const bn = "log-2024-08-04T02:25:10.513Z"
+	s.Put(ctx, "u1", bn, Audio, []byte("ogg data"))
+	s.Put(ctx, "u1", bn, Transcript, []byte("I went to the market."))
+	s.Put(ctx, "u1", bn, Summary, []byte("Market <trip>."))
+	s.PutMeta(ctx, "u1", bn, Meta{Neighborhood: "Clementi", People: []string{"Ah Hock"}})
+	s.Put(ctx, "u1", "log-2024-08-05T00:00:00.000Z", Audio, []byte("not yet transcribed"))
+	s.SetHighlights(ctx, "u1", []string{"Shopping"})
+	s.SetNames(ctx, "u1", "Ah Hock\n")
+
+	for _, format := range Formats {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := s.Export(ctx, &b, "u1", format); err != nil {
+				t.Fatal(err)
+			}
+			files := readArchive(t, format, b.Bytes())
+
+			var m Manifest
+			if err := json.Unmarshal(files["u1/manifest.json"], &m); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Files) != 7 {
+				t.Errorf("files: %+v", m.Files)
+			}
+			for _, f := range m.Files {
+				sum := sha256.Sum256(files["u1/"+f.Name])
+				if hex.EncodeToString(sum[:]) != f.SHA256 || f.Size != len(files["u1/"+f.Name]) {
+					t.Errorf("%s: checksum or size mismatch", f.Name)
+				}
+			}
+			if len(m.Entries) != 2 || m.Entries[0].Basename != "log-2024-08-05T00:00:00.000Z" || m.Entries[0].Summary != "" {
+				t.Fatalf("entries should be newest first: %+v", m.Entries)
+			}
+			if e := m.Entries[1]; e.Audio != bn+".ogg" || e.Transcript != bn+".txt" || e.Summary != bn+".summary.txt" ||
+				e.Meta == nil || e.Meta.Neighborhood != "Clementi" || e.Time.Format(time.DateOnly) != "2024-08-04" {
+				t.Errorf("entry: %+v", e)
+			}
+
+			index := string(files["u1/index.html"])
+			for _, want := range []string{"Market &lt;trip&gt;.", `<audio controls src="./` + bn + `.ogg">`, "I went to the market.",
+				"Where: Clementi. With: Ah Hock.", "Highlights: Shopping.", "Sunday, 4 Aug 2024"} {
+				if !strings.Contains(index, want) {
+					t.Errorf("index.html should contain %q:\n%s", want, index)
+				}
+			}
+		})
+	}
+
+	if err := s.Export(ctx, io.Discard, "nobody", "zip"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown user: %v", err)
+	}
+	if err := s.Export(ctx, io.Discard, "u1", "rar"); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
+
+// readArchive returns the contents of the files in a zip or tar archive.
+func readArchive(t *testing.T, format string, b []byte) map[string][]byte {
+	files := map[string][]byte{}
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name], _ = io.ReadAll(rc)
+			rc.Close()
+		}
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(b))
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[h.Name], _ = io.ReadAll(tr)
+		}
+	}
+	return files
+}
@@ -0,0 +1,69 @@
+package logstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Memory keeps files in memory, for tests and development.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string]map[string][]byte // by user ID and name
+}
+
+// NewMemory returns an empty in-memory backend.
+func NewMemory() *Memory {
+	return &Memory{files: map[string]map[string][]byte{}}
+}
+
+func (m *Memory) Read(ctx context.Context, userID, name string) ([]byte, error) {
+	if err := check(userID, name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.files[userID][name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, b...), nil
+}
+
+func (m *Memory) Write(ctx context.Context, userID, name string, b []byte) error {
+	if err := check(userID, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files[userID] == nil {
+		m.files[userID] = map[string][]byte{}
+	}
+	m.files[userID][name] = append([]byte{}, b...)
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context, userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for n := range m.files[userID] {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *Memory) Users(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []string{}
+	for u := range m.files {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Close is a no-op.
+func (m *Memory) Close() error { return nil }
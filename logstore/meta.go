@@ -0,0 +1,218 @@
+package logstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Meta describes a log entry. It is stored as JSON beside the entry's other parts.
+type Meta struct {
+	Location           *LatLng   `json:"location,omitempty"`
+	Neighborhood       string    `json:"neighborhood,omitempty"`
+	PrimaryHighlight   string    `json:"primaryHighlight,omitempty"`
+	SecondaryHighlight string    `json:"secondaryHighlight,omitempty"`
+	People             []string  `json:"people,omitempty"`
+	Created            time.Time `json:"created"` // when the entry was recorded
+	Updated            time.Time `json:"updated"` // when the transcript was last saved
+	Source             string    `json:"source"`  // "audio" if transcribed from a recording, or "text"
+}
+
+// LatLng is a location in degrees.
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// ParseLatLng parses "lat,lng", eg. "1.35,103.76". It returns nil if s is not a location.
+func ParseLatLng(s string) *LatLng {
+	a, b, ok := strings.Cut(s, ",")
+	if !ok {
+		return nil
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return &LatLng{lat, lng}
+}
+
+// ParsePeople splits a comma separated list of people.
+func ParsePeople(s string) []string {
+	p := []string{}
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			p = append(p, n)
+		}
+	}
+	return p
+}
+
+// String describes m for a prompt, eg. "Where: Bukit Timah. Highlights: Shopping. With: Ah Hock."
+func (m Meta) String() string {
+	s := []string{}
+	if m.Neighborhood != "" {
+		s = append(s, "Where: "+m.Neighborhood+".")
+	}
+	h := []string{}
+	for _, v := range []string{m.PrimaryHighlight, m.SecondaryHighlight} {
+		if v != "" {
+			h = append(h, v)
+		}
+	}
+	if len(h) > 0 {
+		s = append(s, "Highlights: "+strings.Join(h, ", ")+".")
+	}
+	if len(m.People) > 0 {
+		s = append(s, "With: "+strings.Join(m.People, ", ")+".")
+	}
+	return strings.Join(s, " ")
+}
+
+// entryTimeLayout is the time in an entry basename, eg. log-2024-08-04T02:25:10.513Z.
+const entryTimeLayout = "log-2006-01-02T15:04:05.000Z"
+
+// EntryTime returns the time in basename, or false if it has none.
+func EntryTime(basename string) (time.Time, bool) {
+	t, err := time.Parse(entryTimeLayout, basename)
+	return t, err == nil
+}
+
+// MetaFile is the name of an entry's metadata file.
+func MetaFile(basename string) string {
+	return basename + ".meta.json"
+}
+
+// GetMeta returns the metadata of the entry basename of userID, or ErrNotFound.
+func (s *Store) GetMeta(ctx context.Context, userID, basename string) (Meta, error) {
+	var m Meta
+	b, err := s.Read(ctx, userID, MetaFile(basename))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%s: %v", MetaFile(basename), err)
+	}
+	return m, nil
+}
+
+// PutMeta stores the metadata of the entry basename of userID.
+func (s *Store) PutMeta(ctx context.Context, userID, basename string, m Meta) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.Write(ctx, userID, MetaFile(basename), b)
+}
+
+// trailerKeys are the fields of the free text metadata trailer that was
+// appended to transcripts, in order:
+//
+//	---
+//	latlng:1.35,103.76, neighborhood:Bukit Timah, primaryHighlight:Shopping, secondaryHighlight:, people:Ah Hock
+var trailerKeys = []string{"latlng:", ", neighborhood:", ", primaryHighlight:", ", secondaryHighlight:", ", people:"}
+
+// ParseTrailer splits text into the text before a metadata trailer and the
+// metadata in it. ok is false if text has no trailer. Values may contain commas.
+func ParseTrailer(text string) (body string, m Meta, ok bool) {
+	i := strings.LastIndex(text, "\n---\n")
+	if i < 0 {
+		return text, m, false
+	}
+	t := strings.TrimSpace(text[i+len("\n---\n"):])
+	if !strings.HasPrefix(t, trailerKeys[0]) {
+		return text, m, false
+	}
+	v := make([]string, len(trailerKeys))
+	pos := 0
+	for k := range trailerKeys {
+		start := pos + len(trailerKeys[k])
+		end := len(t)
+		if k+1 < len(trailerKeys) {
+			n := strings.Index(t[start:], trailerKeys[k+1])
+			if n < 0 {
+				return text, m, false
+			}
+			end = start + n
+		}
+		v[k] = strings.TrimSpace(t[start:end])
+		pos = end
+	}
+	m = Meta{
+		Location:           ParseLatLng(v[0]),
+		Neighborhood:       v[1],
+		PrimaryHighlight:   v[2],
+		SecondaryHighlight: v[3],
+		People:             ParsePeople(v[4]),
+	}
+	return text[:i], m, true
+}
+
+// Migrate moves the metadata trailers of the transcripts of userID into
+// metadata files, removing the trailers from transcripts and summaries.
+// Entries that already have metadata are skipped. With dryRun nothing is
+// written. It returns the basenames of the entries migrated.
+func (s *Store) Migrate(ctx context.Context, userID string, dryRun bool) ([]string, error) {
+	names, err := s.List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, n := range names {
+		have[n] = true
+	}
+
+	done := []string{}
+	for _, n := range names {
+		if !strings.HasSuffix(n, "."+string(Transcript)) || strings.HasSuffix(n, "."+string(Summary)) {
+			continue
+		}
+		bn := strings.TrimSuffix(n, "."+string(Transcript))
+		if !strings.HasPrefix(bn, "log-") || have[MetaFile(bn)] {
+			continue
+		}
+		b, err := s.Get(ctx, userID, bn, Transcript)
+		if err != nil {
+			return done, err
+		}
+		body, m, ok := ParseTrailer(string(b))
+		if !ok {
+			continue
+		}
+		m.Created, _ = EntryTime(bn)
+		m.Updated = m.Created
+		m.Source = "text"
+		if have[bn+"."+string(Audio)] {
+			m.Source = "audio"
+		}
+		done = append(done, bn)
+		if dryRun {
+			continue
+		}
+
+		if err := s.PutMeta(ctx, userID, bn, m); err != nil {
+			return done, err
+		}
+		if err := s.Put(ctx, userID, bn, Transcript, []byte(body)); err != nil {
+			return done, err
+		}
+		sum, err := s.Get(ctx, userID, bn, Summary)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+		if body, _, ok := ParseTrailer(string(sum)); ok {
+			if err := s.Put(ctx, userID, bn, Summary, []byte(body)); err != nil {
+				return done, err
+			}
+		}
+	}
+	return done, nil
+}
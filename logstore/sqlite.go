@@ -0,0 +1,92 @@
+package logstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// SQLite keeps files in a SQLite database, which several server instances can share.
+type SQLite struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS files (
+	user_id TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	data    BLOB NOT NULL,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (user_id, name)
+)`
+
+// OpenSQLite opens or creates the database file fn.
+func OpenSQLite(fn string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", fn+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (s *SQLite) Read(ctx context.Context, userID, name string) ([]byte, error) {
+	if err := check(userID, name); err != nil {
+		return nil, err
+	}
+	var b []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM files WHERE user_id = ? AND name = ?`, userID, name).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (s *SQLite) Write(ctx context.Context, userID, name string, b []byte) error {
+	if err := check(userID, name); err != nil {
+		return err
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO files (user_id, name, data, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET data = excluded.data, updated = excluded.updated`,
+		userID, name, b, time.Now().Unix())
+	return err
+}
+
+func (s *SQLite) List(ctx context.Context, userID string) ([]string, error) {
+	return s.strings(ctx, `SELECT name FROM files WHERE user_id = ? ORDER BY name`, userID)
+}
+
+func (s *SQLite) Users(ctx context.Context) ([]string, error) {
+	return s.strings(ctx, `SELECT DISTINCT user_id FROM files ORDER BY user_id`)
+}
+
+// strings returns the single column of the rows of query.
+func (s *SQLite) strings(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vals := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, rows.Err()
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
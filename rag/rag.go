@@ -6,4 +6,11 @@ type Doc struct {
 	Content string
 	Context string
 	Embedding []float32
-}
\ No newline at end of file
+	EmbeddingModel string // empty for embeddings created with text-embedding-004
+	Metadata map[string]string // optional, extra attributes stored with the document
+}
+
+// Contexts lists the contexts offered by the aigogo user interface.
+// Documents in other contexts are never retrieved.
+var Contexts = []string{"General", "Singapore", "Petaling Jaya", "Ukay Heights", "Batam",
+	"Ipoh", "Penang", "Yap Guan Chiang Penang", "Yap Guan Chiang Ipoh", "Plants"}
\ No newline at end of file
@@ -0,0 +1,230 @@
+// Package usage records the tokens used by model calls and totals them for reports.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record is the token usage of a model call.
+type Record struct {
+	Time             time.Time `json:"time"`
+	UserID           string    `json:"userID,omitempty"`
+	Endpoint         string    `json:"endpoint"`
+	Model            string    `json:"model"`
+	PromptTokens     int64     `json:"promptTokens"`
+	CandidatesTokens int64     `json:"candidatesTokens"`
+	TotalTokens      int64     `json:"totalTokens"`
+	Cancelled        bool      `json:"cancelled,omitempty"` // the client went away before the response completed
+}
+
+// Day is the UTC date of r, eg. "2024-08-04".
+func (r Record) Day() string {
+	return r.Time.UTC().Format(time.DateOnly)
+}
+
+// Key identifies a group of records. Fields not grouped by are empty.
+type Key struct {
+	Day      string `json:"day,omitempty"`
+	UserID   string `json:"userID,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Model    string `json:"model,omitempty"`
+}
+
+// Totals sums the records of a group.
+type Totals struct {
+	Requests         int   `json:"requests"`
+	PromptTokens     int64 `json:"promptTokens"`
+	CandidatesTokens int64 `json:"candidatesTokens"`
+	TotalTokens      int64 `json:"totalTokens"`
+	Cancelled        int   `json:"cancelled"` // requests of which were cancelled
+}
+
+func (t *Totals) add(u Totals) {
+	t.Requests += u.Requests
+	t.PromptTokens += u.PromptTokens
+	t.CandidatesTokens += u.CandidatesTokens
+	t.TotalTokens += u.TotalTokens
+	t.Cancelled += u.Cancelled
+}
+
+// Row is a line of a report.
+type Row struct {
+	Key
+	Totals
+}
+
+// Dimensions that reports can be grouped by.
+var Dimensions = []string{"day", "user", "endpoint", "model"}
+
+// Filter selects the records in a report. Empty fields match everything.
+type Filter struct {
+	From, To string // inclusive days, eg. "2024-08-01"
+	UserID   string
+}
+
+func (f Filter) match(k Key) bool {
+	return (f.From == "" || k.Day >= f.From) && (f.To == "" || k.Day <= f.To) &&
+		(f.UserID == "" || k.UserID == f.UserID)
+}
+
+// Log appends records to a JSON lines file and keeps running totals per
+// day, user, endpoint and model.
+type Log struct {
+	mu     sync.Mutex
+	fn     string // records are only totalled if empty
+	totals map[Key]Totals
+}
+
+// Open reads the records already in fn, if it exists.
+func Open(fn string) (*Log, error) {
+	l := &Log{fn: fn, totals: map[Key]Totals{}}
+	if fn == "" {
+		return l, nil
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recs, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, r := range recs {
+		l.total(r)
+	}
+	return l, nil
+}
+
+func (l *Log) total(r Record) {
+	k := Key{Day: r.Day(), UserID: r.UserID, Endpoint: r.Endpoint, Model: r.Model}
+	t := l.totals[k]
+	u := Totals{1, r.PromptTokens, r.CandidatesTokens, r.TotalTokens, 0}
+	if r.Cancelled {
+		u.Cancelled = 1
+	}
+	t.add(u)
+	l.totals[k] = t
+}
+
+// Add totals r and appends it to the file.
+func (l *Log) Add(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total(r)
+	if l.fn == "" {
+		return nil
+	}
+	f, err := os.OpenFile(l.fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(r)
+}
+
+// Report groups the totals matching f by the given dimensions.
+func (l *Log) Report(f Filter, by ...string) ([]Row, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return group(l.totals, f, by)
+}
+
+// Read decodes JSON lines records.
+func Read(r io.Reader) ([]Record, error) {
+	recs := []Record{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// Report groups recs matching f by the given dimensions.
+func Report(recs []Record, f Filter, by ...string) ([]Row, error) {
+	l := &Log{totals: map[Key]Totals{}}
+	for _, r := range recs {
+		l.total(r)
+	}
+	return group(l.totals, f, by)
+}
+
+func group(totals map[Key]Totals, f Filter, by []string) ([]Row, error) {
+	keep := map[string]bool{}
+	for _, d := range by {
+		if !isDimension(d) {
+			return nil, fmt.Errorf("unknown dimension %q, want one of %v", d, Dimensions)
+		}
+		keep[d] = true
+	}
+
+	m := map[Key]Totals{}
+	for k, t := range totals {
+		if !f.match(k) {
+			continue
+		}
+		g := Key{}
+		if keep["day"] {
+			g.Day = k.Day
+		}
+		if keep["user"] {
+			g.UserID = k.UserID
+		}
+		if keep["endpoint"] {
+			g.Endpoint = k.Endpoint
+		}
+		if keep["model"] {
+			g.Model = k.Model
+		}
+		gt := m[g]
+		gt.add(t)
+		m[g] = gt
+	}
+
+	rows := []Row{}
+	for k, t := range m {
+		rows = append(rows, Row{k, t})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i].Key, rows[j].Key
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		if a.Endpoint != b.Endpoint {
+			return a.Endpoint < b.Endpoint
+		}
+		return a.Model < b.Model
+	})
+	return rows, nil
+}
+
+func isDimension(d string) bool {
+	for _, v := range Dimensions {
+		if d == v {
+			return true
+		}
+	}
+	return false
+}
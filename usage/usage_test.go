@@ -0,0 +1,62 @@
+package usage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "usage.jsonl")
+	l, err := Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2024, 8, 4, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	for _, r := range []Record{
+		{Time: day1, UserID: "u1", Endpoint: "/retr", Model: "m1", PromptTokens: 10, CandidatesTokens: 5, TotalTokens: 15},
+		{Time: day1, UserID: "u1", Endpoint: "/life", Model: "m1", PromptTokens: 20, CandidatesTokens: 5, TotalTokens: 25},
+		{Time: day2, UserID: "u1", Endpoint: "/retr", Model: "m2", PromptTokens: 1, CandidatesTokens: 1, TotalTokens: 2, Cancelled: true},
+		{Time: day2, UserID: "u2", Endpoint: "/retr", Model: "m1", PromptTokens: 3, CandidatesTokens: 3, TotalTokens: 6},
+	} {
+		if err := l.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reopening the file restores the totals
+	l, err = Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := l.Report(Filter{}, "user", "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{Key{Day: "2024-08-04", UserID: "u1"}, Totals{2, 30, 10, 40, 0}},
+		{Key{Day: "2024-08-05", UserID: "u1"}, Totals{1, 1, 1, 2, 1}},
+		{Key{Day: "2024-08-05", UserID: "u2"}, Totals{1, 3, 3, 6, 0}},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %+v", rows)
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+
+	rows, _ = l.Report(Filter{From: "2024-08-05", UserID: "u1"}, "model")
+	if len(rows) != 1 || rows[0].Model != "m2" || rows[0].TotalTokens != 2 {
+		t.Errorf("filtered: %+v", rows)
+	}
+	rows, _ = l.Report(Filter{To: "2024-08-04"})
+	if len(rows) != 1 || rows[0].Requests != 2 || rows[0].Key != (Key{}) {
+		t.Errorf("grand total: %+v", rows)
+	}
+	if _, err := l.Report(Filter{}, "week"); err == nil {
+		t.Error("unknown dimension should be an error")
+	}
+}